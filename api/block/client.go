@@ -0,0 +1,74 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package block
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/api/base"
+)
+
+// Client allows access to the block API end point.
+type Client struct {
+	base.ClientFacade
+	facade base.FacadeCaller
+}
+
+// NewClient creates a new client for accessing the block API.
+func NewClient(st base.APICallCloser) *Client {
+	frontend, backend := base.NewClientFacade(st, "Block")
+	return &Client{ClientFacade: frontend, facade: backend}
+}
+
+// BlockInfo is a block as reported by the server's List call.
+type BlockInfo struct {
+	Id      string     `json:"id"`
+	Type    string     `json:"type"`
+	Message string     `json:"message,omitempty"`
+	Scope   BlockScope `json:"scope"`
+	Tag     string     `json:"tag"`
+}
+
+// List returns all blocks currently switched on, scoped or otherwise.
+func (c *Client) List() ([]BlockInfo, error) {
+	var result struct {
+		Results []BlockInfo `json:"results"`
+	}
+	if err := c.facade.FacadeCall("List", nil, &result); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return result.Results, nil
+}
+
+// switchBlockOnArgs is the payload for the server's SwitchBlockOn call.
+// An omitted (zero-value) Scope is treated as BlockScope{}, i.e.
+// match-all, which is exactly the historical, unscoped behaviour.
+type switchBlockOnArgs struct {
+	Type    string     `json:"type"`
+	Message string     `json:"message"`
+	Scope   BlockScope `json:"scope"`
+}
+
+// SwitchBlockOn switches on the named block type ("BlockChange",
+// "BlockRemove" or "BlockDestroy") with the given message. By default
+// the block matches every operation, preserving the historical
+// coarse-grained behaviour; passing a scope narrows the block to the
+// operations it covers, e.g. a single facade method or a set of
+// applications. Only the first scope passed is used; any further
+// scopes are ignored.
+func (c *Client) SwitchBlockOn(blockType, msg string, scope ...BlockScope) error {
+	args := switchBlockOnArgs{Type: blockType, Message: msg, Scope: MatchAllScope()}
+	if len(scope) > 0 {
+		args.Scope = scope[0]
+	}
+	return errors.Trace(c.facade.FacadeCall("SwitchBlockOn", args, nil))
+}
+
+// SwitchBlockOff switches off the named block type.
+func (c *Client) SwitchBlockOff(blockType string) error {
+	args := struct {
+		Type string `json:"type"`
+	}{Type: blockType}
+	return errors.Trace(c.facade.FacadeCall("SwitchBlockOff", args, nil))
+}
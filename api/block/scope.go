@@ -0,0 +1,95 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package block
+
+import (
+	"path"
+	"time"
+)
+
+// BlockScope narrows a block down to the operations it actually
+// applies to. The zero value matches everything, which is how the
+// historical coarse blocks (BlockChange, BlockRemove, BlockDestroy)
+// continue to behave.
+type BlockScope struct {
+	// FacadeMethods holds "Facade.Method" glob patterns (as accepted
+	// by path.Match) that the block applies to. A nil or empty slice
+	// means every facade method is blocked.
+	FacadeMethods []string `json:"facade-methods,omitempty"`
+
+	// Applications holds the application names the block applies to.
+	// A nil or empty slice means every application is blocked.
+	Applications []string `json:"applications,omitempty"`
+
+	// From and Until, if non-zero, bound the time window during
+	// which the block is in effect. A zero value on either side means
+	// that side of the window is unbounded.
+	From  time.Time `json:"from,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+// MatchAllScope returns the scope used by the original coarse blocks:
+// every facade method, every application, no time bound.
+func MatchAllScope() BlockScope {
+	return BlockScope{}
+}
+
+// FacadeMethodScope returns a scope that only blocks calls to facade
+// methods matching one of the given "Facade.Method" glob patterns,
+// e.g. "Application.*" or "Client.DestroyModel".
+func FacadeMethodScope(patterns []string) BlockScope {
+	return BlockScope{FacadeMethods: patterns}
+}
+
+// ApplicationScope returns a scope that only blocks operations against
+// one of the named applications (or the units of those applications).
+func ApplicationScope(apps []string) BlockScope {
+	return BlockScope{Applications: apps}
+}
+
+// TimeWindowScope returns a scope that only blocks operations between
+// from and until. Either bound may be the zero Time to leave that side
+// unbounded.
+func TimeWindowScope(from, until time.Time) BlockScope {
+	return BlockScope{From: from, Until: until}
+}
+
+// IsMatchAll reports whether the scope blocks every facade method and
+// application unconditionally, i.e. it behaves like one of the
+// original coarse blocks.
+func (s BlockScope) IsMatchAll() bool {
+	return len(s.FacadeMethods) == 0 && len(s.Applications) == 0 &&
+		s.From.IsZero() && s.Until.IsZero()
+}
+
+// Matches reports whether an operation against the given facade
+// method (formatted "Facade.Method") and application (empty if the
+// operation isn't application-scoped) is covered by this scope at the
+// given time.
+func (s BlockScope) Matches(facadeMethod, application string, now time.Time) bool {
+	if !s.From.IsZero() && now.Before(s.From) {
+		return false
+	}
+	if !s.Until.IsZero() && now.After(s.Until) {
+		return false
+	}
+	if len(s.FacadeMethods) > 0 && !matchesAny(s.FacadeMethods, facadeMethod) {
+		return false
+	}
+	if len(s.Applications) > 0 && !matchesAny(s.Applications, application) {
+		return false
+	}
+	return true
+}
+
+// matchesAny reports whether candidate matches any of the given glob
+// patterns, or is an exact (non-glob) equal to one of them.
+func matchesAny(patterns []string, candidate string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, candidate); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package common
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/api/block"
+)
+
+// ErrOperationBlocked is returned when an operation is forbidden
+// because of a scoped or unscoped block switched on by an operator.
+// Callers should present Message to the user rather than a generic
+// "operation blocked" string, since it's the reason the operator gave
+// when they switched the block on.
+type ErrOperationBlocked struct {
+	Type    string
+	Message string
+}
+
+func (e *ErrOperationBlocked) Error() string {
+	if e.Message == "" {
+		return "operation is blocked"
+	}
+	return e.Message
+}
+
+// BlockChecker is consulted by the apiserver before running a facade
+// method, so that an operator can freeze a subset of changes (e.g. to
+// a single production application) without stopping every other
+// operation in the model.
+type BlockChecker struct {
+	active []activeBlock
+	now    func() time.Time
+}
+
+// activeBlock pairs a switched-on block's type, message and scope.
+type activeBlock struct {
+	blockType string
+	message   string
+	scope     block.BlockScope
+}
+
+// NewBlockChecker returns a BlockChecker with no blocks switched on.
+func NewBlockChecker() *BlockChecker {
+	return &BlockChecker{now: time.Now}
+}
+
+// SwitchOn records that blockType is switched on, scoped to scope, with
+// the given message. An empty (zero-value) scope matches every facade
+// method and application, reproducing the original coarse blocks.
+func (bc *BlockChecker) SwitchOn(blockType, message string, scope block.BlockScope) {
+	bc.active = append(bc.active, activeBlock{blockType: blockType, message: message, scope: scope})
+}
+
+// SwitchOff removes every block of the given type, scoped or not.
+func (bc *BlockChecker) SwitchOff(blockType string) {
+	kept := bc.active[:0]
+	for _, b := range bc.active {
+		if b.blockType != blockType {
+			kept = append(kept, b)
+		}
+	}
+	bc.active = kept
+}
+
+// CheckBlocked returns an *ErrOperationBlocked if any block of
+// blockType is switched on and its scope covers the given facade
+// method (formatted "Facade.Method") and application (empty if the
+// call isn't application-scoped, e.g. a model-wide operation). It
+// returns nil if the operation is permitted, which includes every
+// case where only non-matching scoped blocks are active.
+func (bc *BlockChecker) CheckBlocked(blockType, facadeMethod, application string) error {
+	now := bc.now()
+	for _, b := range bc.active {
+		if b.blockType != blockType {
+			continue
+		}
+		if b.scope.Matches(facadeMethod, application, now) {
+			return errors.Trace(&ErrOperationBlocked{Type: blockType, Message: b.message})
+		}
+	}
+	return nil
+}
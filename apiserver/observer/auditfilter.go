@@ -5,10 +5,10 @@ package observer
 
 import (
 	"fmt"
+	"path"
 	"sync"
 
 	"github.com/juju/errors"
-	"github.com/juju/utils/set"
 
 	"github.com/juju/juju/core/auditlog"
 )
@@ -21,6 +21,13 @@ type bufferedLog struct {
 	buffer      []interface{}
 	dest        auditlog.AuditLog
 	interesting func(auditlog.Request) bool
+
+	// excludeWho, if set, is consulted in AddConversation: a
+	// conversation it rejects is dropped immediately, without ever
+	// being buffered, so a long-lived read-only session from an
+	// excluded user never accumulates memory for buffered messages
+	// that will never be flushed.
+	excludeWho func(who string) bool
 }
 
 // NewAuditLogFilter returns an auditlog.AuditLog that will only log
@@ -33,10 +40,135 @@ func NewAuditLogFilter(log auditlog.AuditLog, filter func(auditlog.Request) bool
 	}
 }
 
+// AuditFilterConfig configures the rule-based filter built by
+// NewAuditLogFilterFromConfig. It's intended to be populated from the
+// model config attributes "audit-log-exclude-methods" and
+// "audit-log-include-users".
+type AuditFilterConfig struct {
+	// ExcludeMethods lists "Facade.Method" glob patterns (as matched
+	// by path.Match) that are not, by themselves, interesting enough
+	// to trigger logging - e.g. "Client.*Status" or "Pinger.*".
+	ExcludeMethods []string
+
+	// SampleMethods maps an entry from ExcludeMethods to a sample
+	// rate N: every Nth otherwise-uninteresting call whose
+	// "Facade.Method" matches the pattern is logged anyway, so
+	// operators keep statistical coverage of high-volume read methods
+	// without logging every one of them.
+	SampleMethods map[string]int
+
+	// IncludeUsers and ExcludeUsers list user tag glob patterns
+	// checked against Conversation.Who. A conversation is dropped
+	// entirely if its user matches ExcludeUsers, or if IncludeUsers is
+	// non-empty and the user matches none of its patterns.
+	// ExcludeUsers takes priority over IncludeUsers.
+	IncludeUsers []string
+	ExcludeUsers []string
+}
+
+// FilterUpdater is implemented by audit logs whose filtering rules can
+// be swapped out after construction, such as the one returned by
+// NewAuditLogFilterFromConfig. This is the integration point for
+// making audit-log-* config changes take effect live: this package has
+// no access to State or its watchers, so it's up to whoever
+// constructs the audit log (the apiserver, which does have a
+// ModelConfig watcher already) to type-assert the result to
+// FilterUpdater and call SetFilterConfig from that watch loop whenever
+// audit-log-exclude-methods, audit-log-include-users or
+// audit-log-exclude-users changes, rather than restarting the
+// controller.
+type FilterUpdater interface {
+	SetFilterConfig(cfg AuditFilterConfig)
+}
+
+// NewAuditLogFilterFromConfig returns an auditlog.AuditLog whose
+// filtering rules - which methods are interesting, which excluded
+// methods are still sampled, and which users are excluded altogether -
+// come from cfg. The returned log also implements FilterUpdater, so
+// the rules can be changed later, atomically, without losing any
+// state buffered under the old ones.
+func NewAuditLogFilterFromConfig(log auditlog.AuditLog, cfg AuditFilterConfig) auditlog.AuditLog {
+	l := &bufferedLog{dest: log}
+	l.SetFilterConfig(cfg)
+	return l
+}
+
+// SetFilterConfig implements FilterUpdater, swapping in new filtering
+// rules under the same mutex that guards the buffer, so a concurrent
+// AddRequest/AddConversation always sees a consistent set of rules.
+func (l *bufferedLog) SetFilterConfig(cfg AuditFilterConfig) {
+	interesting := buildMethodFilter(cfg)
+	excludeWho := buildUserFilter(cfg)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interesting = interesting
+	l.excludeWho = excludeWho
+}
+
+// buildMethodFilter returns the "is this request interesting" rule
+// described by cfg: requests whose "Facade.Method" doesn't match any
+// ExcludeMethods pattern are always interesting; others are logged
+// only on every Nth occurrence, if the pattern has a sample rate.
+func buildMethodFilter(cfg AuditFilterConfig) func(auditlog.Request) bool {
+	sampleCounts := make(map[string]int, len(cfg.SampleMethods))
+	var mu sync.Mutex
+
+	return func(req auditlog.Request) bool {
+		name := fmt.Sprintf("%s.%s", req.Facade, req.Method)
+		pattern, excluded := matchAny(cfg.ExcludeMethods, name)
+		if !excluded {
+			return true
+		}
+		rate, ok := cfg.SampleMethods[pattern]
+		if !ok || rate <= 0 {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sampleCounts[pattern]++
+		return sampleCounts[pattern]%rate == 0
+	}
+}
+
+// buildUserFilter returns the "drop this conversation's user
+// entirely" rule described by cfg.
+func buildUserFilter(cfg AuditFilterConfig) func(who string) bool {
+	if len(cfg.IncludeUsers) == 0 && len(cfg.ExcludeUsers) == 0 {
+		return nil
+	}
+	return func(who string) bool {
+		if _, denied := matchAny(cfg.ExcludeUsers, who); denied {
+			return true
+		}
+		if len(cfg.IncludeUsers) == 0 {
+			return false
+		}
+		_, allowed := matchAny(cfg.IncludeUsers, who)
+		return !allowed
+	}
+}
+
+// matchAny reports whether name matches any of the given glob
+// patterns, returning the first pattern it matched.
+func matchAny(patterns []string, name string) (matched string, ok bool) {
+	for _, pattern := range patterns {
+		if m, err := path.Match(pattern, name); err == nil && m {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
 // AddConversation implements auditlog.AuditLog.
 func (l *bufferedLog) AddConversation(c auditlog.Conversation) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.excludeWho != nil && l.excludeWho(c.Who) {
+		// This user's conversations are never interesting, so don't
+		// even buffer it - there's nothing to flush it into later.
+		return nil
+	}
 	// We always buffer the conversation, since we don't know whether
 	// it will have any interesting requests yet.
 	l.deferMessage(c)
@@ -104,13 +236,3 @@ func (l *bufferedLog) flush() error {
 	l.buffer = nil
 	return nil
 }
-
-// InterestingRequest returns whether this API request is interesting enough
-// to write the conversation to the audit log.
-func InterestingRequest(req auditlog.Request) bool {
-	return !readOnlyMethods.Contains(fmt.Sprintf("%s.%s", req.Facade, req.Method))
-}
-
-var readOnlyMethods = set.NewStrings(
-	"Client.FullStatus",
-)
@@ -0,0 +1,486 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package observer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/juju/juju/core/auditlog"
+)
+
+// SinkTransport selects the wire protocol NewRemoteAuditLog uses to
+// reach the external collector.
+type SinkTransport int
+
+const (
+	// SinkSyslog sends each record as an RFC 5424 syslog message over
+	// TCP, optionally wrapped in TLS.
+	SinkSyslog SinkTransport = iota
+
+	// SinkFluentd sends each record as a fluentd forward-protocol
+	// entry (msgpack-encoded [tag, time, record] arrays) over TCP.
+	SinkFluentd
+
+	// SinkHTTPS POSTs batches of records as newline-delimited JSON to
+	// an HTTPS endpoint.
+	SinkHTTPS
+)
+
+// BackpressurePolicy decides what happens when the in-memory queue is
+// full and another record arrives.
+type BackpressurePolicy int
+
+const (
+	// DropOldest discards the oldest queued record to make room.
+	DropOldest BackpressurePolicy = iota
+
+	// Block makes the caller wait until there's room in the queue.
+	Block
+
+	// FailRequest returns an error to the caller instead of queuing.
+	FailRequest
+)
+
+// RemoteSinkConfig configures NewRemoteAuditLog.
+type RemoteSinkConfig struct {
+	// Transport selects the wire protocol.
+	Transport SinkTransport
+
+	// Addr is the collector address: "host:port" for syslog and
+	// fluentd, or a full URL for SinkHTTPS.
+	Addr string
+
+	// TLSConfig, if non-nil, is used to secure the syslog connection
+	// or the HTTPS client.
+	TLSConfig *tls.Config
+
+	// QueueSize bounds the number of records held in memory awaiting
+	// delivery. Defaults to 1000.
+	QueueSize int
+
+	// Backpressure chooses what happens when the queue is full.
+	Backpressure BackpressurePolicy
+
+	// SpillDir, if set, is a directory that undelivered records are
+	// appended to (as JSON lines) when the collector can't be
+	// reached, so nothing is lost across an extended outage. The
+	// spill file is replayed before new records once the collector
+	// becomes reachable again.
+	SpillDir string
+
+	// BatchSize is the number of records a SinkHTTPS flush sends in
+	// one POST. Defaults to 100. Ignored by the other transports,
+	// which send one record per connection write.
+	BatchSize int
+
+	// FlushInterval is how often the background flusher wakes up to
+	// drain the queue, even if it isn't full. Defaults to time.Second.
+	FlushInterval time.Duration
+
+	// CloseTimeout bounds how long Close waits for the queue to drain
+	// before giving up. Defaults to 5 seconds.
+	CloseTimeout time.Duration
+}
+
+// sink is the minimal interface a transport must implement to be
+// driven by remoteAuditLog's flush loop.
+type sink interface {
+	// send delivers a batch of already-JSON-marshalled records.
+	send(records [][]byte) error
+	Close() error
+}
+
+// NewRemoteAuditLog returns an auditlog.AuditLog that streams records
+// to an external collector over cfg.Transport. It queues records in
+// memory, applying cfg.Backpressure once the queue fills, and drains
+// that queue in the background with exponential backoff across
+// transport failures, spilling undelivered records to disk if
+// cfg.SpillDir is set. It's commonly wrapped in NewAuditLogFilter so
+// only interesting conversations reach the remote collector.
+func NewRemoteAuditLog(cfg RemoteSinkConfig) (auditlog.AuditLog, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.CloseTimeout <= 0 {
+		cfg.CloseTimeout = 5 * time.Second
+	}
+
+	s, err := newSink(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	l := &remoteAuditLog{
+		cfg:     cfg,
+		sink:    s,
+		queue:   make(chan []byte, cfg.QueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go l.loop()
+	return l, nil
+}
+
+func newSink(cfg RemoteSinkConfig) (sink, error) {
+	switch cfg.Transport {
+	case SinkSyslog:
+		return newSyslogSink(cfg)
+	case SinkFluentd:
+		return newFluentdSink(cfg)
+	case SinkHTTPS:
+		return newHTTPSSink(cfg)
+	default:
+		return nil, errors.Errorf("unknown audit log sink transport %v", cfg.Transport)
+	}
+}
+
+// remoteAuditLog is the auditlog.AuditLog implementation returned by
+// NewRemoteAuditLog.
+type remoteAuditLog struct {
+	cfg  RemoteSinkConfig
+	sink sink
+
+	queue   chan []byte
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// AddConversation implements auditlog.AuditLog.
+func (l *remoteAuditLog) AddConversation(c auditlog.Conversation) error {
+	return l.enqueue(struct {
+		Type string `json:"type"`
+		auditlog.Conversation
+	}{"conversation", c})
+}
+
+// AddRequest implements auditlog.AuditLog.
+func (l *remoteAuditLog) AddRequest(r auditlog.Request) error {
+	return l.enqueue(struct {
+		Type string `json:"type"`
+		auditlog.Request
+	}{"request", r})
+}
+
+// AddResponse implements auditlog.AuditLog.
+func (l *remoteAuditLog) AddResponse(r auditlog.ResponseErrors) error {
+	return l.enqueue(struct {
+		Type string `json:"type"`
+		auditlog.ResponseErrors
+	}{"response", r})
+}
+
+func (l *remoteAuditLog) enqueue(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	select {
+	case l.queue <- data:
+		return nil
+	default:
+	}
+
+	switch l.cfg.Backpressure {
+	case Block:
+		select {
+		case l.queue <- data:
+			return nil
+		case <-l.closing:
+			return errors.New("audit log sink is closing")
+		}
+	case FailRequest:
+		return errors.New("audit log queue is full")
+	default: // DropOldest
+		select {
+		case <-l.queue:
+		default:
+		}
+		select {
+		case l.queue <- data:
+		default:
+		}
+		return nil
+	}
+}
+
+// Close implements auditlog.AuditLog, draining the queue (with a
+// deadline) before shutting down the transport.
+func (l *remoteAuditLog) Close() error {
+	close(l.closing)
+	select {
+	case <-l.done:
+	case <-time.After(l.cfg.CloseTimeout):
+	}
+	return errors.Trace(l.sink.Close())
+}
+
+// loop is the background flusher: it batches up to cfg.BatchSize
+// queued records (fewer if the queue runs dry first) and hands them
+// to the sink, waiting FlushInterval before polling an empty queue
+// again. A failed batch is spilled to disk (if SpillDir is set) and
+// the loop backs off exponentially before the next send.
+func (l *remoteAuditLog) loop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	backoff := time.Second
+	const maxBackoff = time.Minute
+
+	for {
+		batch := l.collect(ticker.C)
+		if len(batch) == 0 {
+			select {
+			case <-l.closing:
+				return
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		if err := l.deliver(batch); err != nil {
+			l.spill(batch)
+			select {
+			case <-time.After(backoff):
+			case <-l.closing:
+				return
+			}
+			if backoff < maxBackoff {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		select {
+		case <-l.closing:
+			if len(l.queue) == 0 {
+				return
+			}
+		default:
+		}
+	}
+}
+
+// collect drains up to BatchSize records from the queue, returning
+// early if tick fires first or the queue is empty.
+func (l *remoteAuditLog) collect(tick <-chan time.Time) [][]byte {
+	var batch [][]byte
+	for len(batch) < l.cfg.BatchSize {
+		select {
+		case record := <-l.queue:
+			batch = append(batch, record)
+		case <-tick:
+			return batch
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliver replays any spilled records before sending batch, so spilled
+// records are never reordered ahead of newer ones for long.
+func (l *remoteAuditLog) deliver(batch [][]byte) error {
+	if err := l.replaySpill(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(l.sink.send(batch))
+}
+
+func (l *remoteAuditLog) spillPath() string {
+	return l.cfg.SpillDir + "/audit-log.spill"
+}
+
+// spill appends undelivered records to the spill file, if configured.
+func (l *remoteAuditLog) spill(batch [][]byte) {
+	if l.cfg.SpillDir == "" {
+		return
+	}
+	f, err := os.OpenFile(l.spillPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, record := range batch {
+		w.Write(record)
+		w.WriteByte('\n')
+	}
+	w.Flush()
+}
+
+// replaySpill sends and removes any records left over from a previous
+// outage, before new records are sent.
+func (l *remoteAuditLog) replaySpill() error {
+	if l.cfg.SpillDir == "" {
+		return nil
+	}
+	f, err := os.Open(l.spillPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	var spilled [][]byte
+	scanner := newLineScanner(f)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		spilled = append(spilled, line)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(spilled) == 0 {
+		return nil
+	}
+
+	if err := l.sink.send(spilled); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Remove(l.spillPath()))
+}
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	return bufio.NewScanner(r)
+}
+
+// syslogSink sends each record as an RFC 5424 message over TCP,
+// optionally secured with TLS.
+type syslogSink struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(cfg RemoteSinkConfig) (*syslogSink, error) {
+	conn, err := dial(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &syslogSink{conn: conn}, nil
+}
+
+func (s *syslogSink) send(records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		msg := fmt.Sprintf("<14>1 - - juju-controller audit - - - %s\n", record)
+		if _, err := io.WriteString(s.conn, msg); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// fluentdSink sends each record as a fluentd forward-protocol entry
+// ([tag, unix-time, record]) over TCP.
+type fluentdSink struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newFluentdSink(cfg RemoteSinkConfig) (*fluentdSink, error) {
+	conn, err := dial(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fluentdSink{conn: conn}, nil
+}
+
+func (s *fluentdSink) send(records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(record, &fields); err != nil {
+			return errors.Trace(err)
+		}
+		entry := []interface{}{"juju.audit", time.Now().Unix(), fields}
+		data, err := msgpack.Marshal(entry)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := s.conn.Write(data); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (s *fluentdSink) Close() error {
+	return s.conn.Close()
+}
+
+func dial(cfg RemoteSinkConfig) (net.Conn, error) {
+	if cfg.TLSConfig != nil {
+		return tls.Dial("tcp", cfg.Addr, cfg.TLSConfig)
+	}
+	return net.Dial("tcp", cfg.Addr)
+}
+
+// httpsSink POSTs batches of records as newline-delimited JSON.
+type httpsSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSSink(cfg RemoteSinkConfig) (*httpsSink, error) {
+	transport := &http.Transport{}
+	if cfg.TLSConfig != nil {
+		transport.TLSClientConfig = cfg.TLSConfig
+	}
+	return &httpsSink{
+		url:    cfg.Addr,
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *httpsSink) send(records [][]byte) error {
+	body := &bytes.Buffer{}
+	for _, record := range records {
+		body.Write(record)
+		body.WriteByte('\n')
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("audit log collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpsSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package block
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju/api/block"
+)
+
+// blockListAPI is the subset of the block API client that
+// listBlocksCommand needs, pulled out so tests can supply a fake.
+type blockListAPI interface {
+	List() ([]block.BlockInfo, error)
+	Close() error
+}
+
+// listBlocksCommand implements "juju list-blocks".
+type listBlocksCommand struct {
+	cmd.CommandBase
+
+	// newAPI returns the client to list blocks from. It's a field so
+	// tests can swap in a fake without a real API connection.
+	newAPI func() (blockListAPI, error)
+
+	// scope, when set via --scope, adds a column describing each
+	// block's facade methods, applications and time window ("all
+	// changes" for an unscoped block).
+	scope bool
+}
+
+// NewListBlocksCommand returns the command for "juju list-blocks".
+func NewListBlocksCommand(newAPI func() (blockListAPI, error)) cmd.Command {
+	return &listBlocksCommand{newAPI: newAPI}
+}
+
+// Info implements cmd.Command.
+func (c *listBlocksCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "list-blocks",
+		Purpose: "List the blocks currently switched on for the model.",
+		Doc: `
+By default each block is shown as a single row giving its type and
+message. Passing --scope adds a column describing exactly which facade
+methods, applications or time window the block applies to, so an
+operator can tell a block that freezes a single application apart from
+one that freezes the whole model.
+`,
+	}
+}
+
+// SetFlags implements cmd.Command.
+func (c *listBlocksCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.BoolVar(&c.scope, "scope", false, "show the facade methods, applications or time window each block applies to")
+}
+
+// Run implements cmd.Command.
+func (c *listBlocksCommand) Run(ctx *cmd.Context) error {
+	api, err := c.newAPI()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer api.Close()
+
+	blocks, err := api.List()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tw := tabwriter.NewWriter(ctx.Stdout, 0, 2, 2, ' ', 0)
+	if c.scope {
+		fmt.Fprintln(tw, "TYPE\tMESSAGE\tSCOPE")
+	} else {
+		fmt.Fprintln(tw, "TYPE\tMESSAGE")
+	}
+	for _, b := range blocks {
+		if c.scope {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", b.Type, b.Message, formatScope(b.Scope))
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\n", b.Type, b.Message)
+		}
+	}
+	return tw.Flush()
+}
+
+// formatScope renders a BlockScope the way --scope displays it: "all
+// changes" for the match-all scope the original coarse blocks use,
+// otherwise a semicolon-separated description of whichever dimensions
+// narrow it.
+func formatScope(scope block.BlockScope) string {
+	if scope.IsMatchAll() {
+		return "all changes"
+	}
+	var parts []string
+	if len(scope.FacadeMethods) > 0 {
+		parts = append(parts, fmt.Sprintf("methods: %s", strings.Join(scope.FacadeMethods, ", ")))
+	}
+	if len(scope.Applications) > 0 {
+		parts = append(parts, fmt.Sprintf("applications: %s", strings.Join(scope.Applications, ", ")))
+	}
+	if !scope.From.IsZero() || !scope.Until.IsZero() {
+		parts = append(parts, fmt.Sprintf("window: %s to %s", scope.From, scope.Until))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package auditlog defines the records written to the controller's
+// audit log and the interface that the various log implementations
+// (file-backed, filtered, signed, ...) satisfy.
+package auditlog
+
+import "time"
+
+// AuditLog is the interface implemented by anything that can record
+// an API conversation for audit purposes. A single conversation
+// generates one AddConversation call, any number of AddRequest calls,
+// and a matching number of AddResponse calls.
+type AuditLog interface {
+	// AddConversation records the start of a new API connection.
+	AddConversation(c Conversation) error
+
+	// AddRequest records an API request made during a conversation
+	// previously passed to AddConversation.
+	AddRequest(r Request) error
+
+	// AddResponse records the outcome of a request previously passed
+	// to AddRequest.
+	AddResponse(r ResponseErrors) error
+
+	// Close releases any resources held by the log.
+	Close() error
+}
+
+// Conversation records the metadata for a new API connection.
+type Conversation struct {
+	// Who connected.
+	Who string
+
+	// What model they connected to.
+	ModelUUID string
+
+	// ConnectionID distinguishes this conversation from any other
+	// using the same controller.
+	ConnectionID string
+
+	// When the conversation started.
+	When time.Time
+}
+
+// Request records a single API request within a conversation.
+type Request struct {
+	// ConversationID ties this request back to its Conversation.
+	ConversationID string
+
+	// RequestID distinguishes this request from others in the same
+	// conversation.
+	RequestID uint64
+
+	// When the request was received.
+	When time.Time
+
+	// Facade and Method identify the API call, e.g. "Client" and
+	// "FullStatus".
+	Facade  string
+	Method  string
+	Version int
+
+	// Args is the canonical-JSON-encoded argument to the call.
+	Args string
+}
+
+// ResponseErrors records the errors (if any) from a single request.
+type ResponseErrors struct {
+	// ConversationID and RequestID tie this response back to the
+	// Request it answers.
+	ConversationID string
+	RequestID      uint64
+
+	// When the response was sent.
+	When time.Time
+
+	// Errors holds the string form of any errors returned by the call.
+	Errors []string
+}
+
+// Checkpoint records the state of a tamper-evident, hash-chained audit
+// log at some point in its history. It's written periodically (and on
+// Close) by a signing AuditLog so that the chain can be verified, and
+// restarted, without replaying the whole log.
+type Checkpoint struct {
+	// When the checkpoint was taken.
+	When time.Time
+
+	// FirstSeq and LastSeq are the inclusive sequence numbers of the
+	// records covered since the previous checkpoint.
+	FirstSeq uint64
+	LastSeq  uint64
+
+	// HeadDigest is the SHA-256 chain digest after record LastSeq.
+	HeadDigest []byte
+
+	// Signature is the Ed25519 signature of HeadDigest, made with the
+	// controller's signing key.
+	Signature []byte
+}
+
+// CheckpointWriter is an optional capability of an AuditLog: a
+// destination that can persist Checkpoint records alongside the
+// conversations, requests and responses it already stores. Logs that
+// don't implement it simply don't retain checkpoints written to them.
+type CheckpointWriter interface {
+	AddCheckpoint(Checkpoint) error
+}
@@ -1,10 +1,12 @@
 package ec2
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"strings"
+	"sort"
+	"sync"
 )
 
 // instanceConstraint constrains the possible instances that may be
@@ -13,80 +15,253 @@ type instanceConstraint struct {
 	series string // Ubuntu release name.
 	arch   string
 	region string
+
+	// virtType selects the virtualisation type of the image, e.g.
+	// "pv" or "hvm". If empty, either type is acceptable.
+	virtType string
+
+	// storage selects the root store of the image, e.g. "ebs" or
+	// "instance-store". If empty, either is acceptable.
+	storage string
 }
 
 // instanceSpec specifies a particular kind of instance.
 type instanceSpec struct {
-	imageId string
-	arch    string
-	series  string
+	imageId  string
+	arch     string
+	series   string
+	virtType string
+	storage  string
 }
 
-// imagesHost holds the address of the images http server.
+// imagesHost holds the address of the simplestreams data server.
 // It is a variable so that tests can change it to refer to a local
 // server when needed.
 var imagesHost = "http://cloud-images.ubuntu.com"
 
-// Columns in the file returned from the images server.
-const (
-	colSeries = iota
-	colServer
-	colDaily
-	colDate
-	colEBS
-	colArch
-	colRegion
-	colImageId
-	_
-	_
-	colVtype
-	colMax
-	// + more that we don't care about.
+// simplestreamsIndexPath is the well-known location of the top-level
+// index file relative to imagesHost.
+const simplestreamsIndexPath = "/streams/v1/index.sjson"
+
+// simplestreamsProductPrefix identifies the product family we care
+// about; the full product id is this prefix plus "<series>:<arch>".
+const simplestreamsProductPrefix = "com.ubuntu.cloud:server"
+
+// ssIndex is the top-level simplestreams index document.
+type ssIndex struct {
+	Indexes map[string]ssIndexEntry `json:"index"`
+}
+
+type ssIndexEntry struct {
+	ProductsFilePath string   `json:"path"`
+	Products         []string `json:"products"`
+}
+
+// ssProducts is the per-index products document, containing one
+// product per series/arch combination, each with a set of versions.
+type ssProducts struct {
+	Products map[string]ssProduct `json:"products"`
+}
+
+type ssProduct struct {
+	Versions map[string]ssVersion `json:"versions"`
+}
+
+type ssVersion struct {
+	Items map[string]ssItem `json:"items"`
+}
+
+type ssItem struct {
+	Id       string `json:"id"`
+	Region   string `json:"region"`
+	Arch     string `json:"arch"`
+	VirtType string `json:"virt"`
+	RootDisk string `json:"root_store"`
+}
+
+// ssCacheEntry holds a parsed products document along with the ETag
+// it was served with, so repeated lookups against the same host don't
+// reparse (or even refetch) the full catalog.
+type ssCacheEntry struct {
+	products *ssProducts
+	etag     string
+}
+
+var (
+	ssCacheMu sync.Mutex
+	ssCache   = make(map[string]*ssCacheEntry)
 )
 
-// fndInstanceSpec finds a suitable instance specification given
-// the provided constraints.
-func findInstanceSpec(spec *instanceConstraint) (*instanceSpec, error) {
-	hclient := new(http.Client)
-	uri := fmt.Sprintf(imagesHost+"/query/%s/%s/%s.current.txt",
-		spec.series,
-		"server",   // variant.
-		"released", // version.
-	)
-	resp, err := hclient.Get(uri)
-	if err == nil && resp.StatusCode != 200 {
-		err = fmt.Errorf("%s", resp.Status)
+// fetchSimplestreamsProducts returns the parsed products document for
+// the given series, using a cached copy keyed by host+products-file-path
+// when the server confirms (via ETag / If-None-Match) that nothing has
+// changed. Two series can share the same products file, in which case
+// they share this cache entry too.
+func fetchSimplestreamsProducts(host, series string) (*ssProducts, error) {
+	index, err := fetchIndex(host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get simplestreams index: %v", err)
+	}
+	entry, ok := index.Indexes["com.ubuntu.cloud:released:aws"]
+	if !ok {
+		return nil, fmt.Errorf("no released aws index found")
+	}
+	productId := fmt.Sprintf("%s:%s:amd64", simplestreamsProductPrefix, series)
+	found := false
+	for _, id := range entry.Products {
+		if id == productId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no image products found for series %q", series)
 	}
+
+	cacheKey := host + entry.ProductsFilePath
+	ssCacheMu.Lock()
+	cached := ssCache[cacheKey]
+	ssCacheMu.Unlock()
+
+	req, err := http.NewRequest("GET", host+entry.ProductsFilePath, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error getting instance types: %v", err)
+		return nil, err
+	}
+	if cached != nil && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	r := bufio.NewReader(resp.Body)
-	for {
-		line, _, err := r.ReadLine()
-		if err != nil {
-			return nil, fmt.Errorf("cannot find matching image: %v (%#v)", err, spec)
-		}
-		f := strings.Split(string(line), "\t")
-		if len(f) < colMax {
-			continue
-		}
-		if f[colVtype] == "hvm" {
-			continue
-		}
-		if f[colEBS] != "ebs" {
-			continue
-		}
-		if f[colArch] == spec.arch && f[colRegion] == spec.region {
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.products, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var products ssProducts
+	if err := json.Unmarshal(body, &products); err != nil {
+		return nil, fmt.Errorf("cannot parse products file: %v", err)
+	}
+
+	ssCacheMu.Lock()
+	ssCache[cacheKey] = &ssCacheEntry{
+		products: &products,
+		etag:     resp.Header.Get("ETag"),
+	}
+	ssCacheMu.Unlock()
+
+	return &products, nil
+}
+
+// ssIndexCacheEntry holds a parsed index document along with the ETag
+// it was served with, so repeated lookups against the same host don't
+// reparse (or even refetch) the index.
+type ssIndexCacheEntry struct {
+	index *ssIndex
+	etag  string
+}
+
+var (
+	ssIndexCacheMu sync.Mutex
+	ssIndexCache   = make(map[string]*ssIndexCacheEntry)
+)
+
+// fetchIndex returns the parsed top-level simplestreams index for
+// host, using a cached copy keyed by host when the server confirms
+// (via ETag / If-None-Match) that nothing has changed.
+func fetchIndex(host string) (*ssIndex, error) {
+	ssIndexCacheMu.Lock()
+	cached := ssIndexCache[host]
+	ssIndexCacheMu.Unlock()
+
+	req, err := http.NewRequest("GET", host+simplestreamsIndexPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.index, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var index ssIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse index file: %v", err)
+	}
+
+	ssIndexCacheMu.Lock()
+	ssIndexCache[host] = &ssIndexCacheEntry{
+		index: &index,
+		etag:  resp.Header.Get("ETag"),
+	}
+	ssIndexCacheMu.Unlock()
+
+	return &index, nil
+}
+
+// findInstanceSpec finds a suitable instance specification given
+// the provided constraints, using the simplestreams image metadata
+// served from imagesHost.
+func findInstanceSpec(spec *instanceConstraint) (*instanceSpec, error) {
+	products, err := fetchSimplestreamsProducts(imagesHost, spec.series)
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance types: %v", err)
+	}
+	productId := fmt.Sprintf("%s:%s:%s", simplestreamsProductPrefix, spec.series, spec.arch)
+	product, ok := products.Products[productId]
+	if !ok {
+		return nil, fmt.Errorf("cannot find matching image: no product %q", productId)
+	}
+
+	versions := make([]string, 0, len(product.Versions))
+	for v := range product.Versions {
+		versions = append(versions, v)
+	}
+	// Walk versions in reverse-chronological order, newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+
+	for _, v := range versions {
+		for _, item := range product.Versions[v].Items {
+			if item.Arch != spec.arch || item.Region != spec.region {
+				continue
+			}
+			if spec.virtType != "" && item.VirtType != spec.virtType {
+				continue
+			}
+			if spec.storage != "" && item.RootDisk != spec.storage {
+				continue
+			}
 			return &instanceSpec{
-				imageId: f[colImageId],
-				arch:    spec.arch,
-				series:  spec.series,
+				imageId:  item.Id,
+				arch:     spec.arch,
+				series:   spec.series,
+				virtType: item.VirtType,
+				storage:  item.RootDisk,
 			}, nil
 		}
 	}
-	panic("not reached")
+	return nil, fmt.Errorf("cannot find matching image: %#v", spec)
 }
 
 func either(yes bool, a, b string) string {
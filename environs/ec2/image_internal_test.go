@@ -0,0 +1,160 @@
+package ec2
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "launchpad.net/gocheck"
+	"launchpad.net/juju-core/testing"
+)
+
+type imageSuite struct {
+	testing.LoggingSuite
+}
+
+var _ = Suite(&imageSuite{})
+
+// fakeSimplestreamsTree serves a minimal, hand-built simplestreams
+// index + products file over HTTP, with ETag support, so tests can
+// exercise fetchIndex/fetchSimplestreamsProducts/findInstanceSpec
+// without reaching the real cloud-images.ubuntu.com.
+type fakeSimplestreamsTree struct {
+	server *httptest.Server
+
+	// indexHits and productsHits count every request served for each
+	// path, including ones answered with 304, so tests can assert
+	// that a cached fetch didn't refetch the body.
+	indexHits    int
+	productsHits int
+}
+
+const fakeProductsPath = "/streams/v1/com.ubuntu.cloud:released:aws.json"
+
+func newFakeSimplestreamsTree(index, products []byte) *fakeSimplestreamsTree {
+	t := &fakeSimplestreamsTree{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(simplestreamsIndexPath, func(w http.ResponseWriter, r *http.Request) {
+		t.indexHits++
+		serveWithETag(w, r, index, "index-etag")
+	})
+	mux.HandleFunc(fakeProductsPath, func(w http.ResponseWriter, r *http.Request) {
+		t.productsHits++
+		serveWithETag(w, r, products, "products-etag")
+	})
+	t.server = httptest.NewServer(mux)
+	return t
+}
+
+func serveWithETag(w http.ResponseWriter, r *http.Request, body []byte, etag string) {
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Write(body)
+}
+
+func (t *fakeSimplestreamsTree) Close() {
+	t.server.Close()
+}
+
+var fakeIndexJSON = []byte(fmt.Sprintf(`{
+	"index": {
+		"com.ubuntu.cloud:released:aws": {
+			"path": %q,
+			"products": ["com.ubuntu.cloud:server:trusty:amd64"]
+		}
+	}
+}`, fakeProductsPath))
+
+var fakeProductsJSON = []byte(`{
+	"products": {
+		"com.ubuntu.cloud:server:trusty:amd64": {
+			"versions": {
+				"20140101": {
+					"items": {
+						"us-east-1he": {
+							"id": "ami-hvmebs",
+							"region": "us-east-1",
+							"arch": "amd64",
+							"virt": "hvm",
+							"root_store": "ebs"
+						},
+						"us-east-1pi": {
+							"id": "ami-pvinstance",
+							"region": "us-east-1",
+							"arch": "amd64",
+							"virt": "pv",
+							"root_store": "instance-store"
+						}
+					}
+				}
+			}
+		}
+	}
+}`)
+
+func (s *imageSuite) SetUpTest(c *C) {
+	s.LoggingSuite.SetUpTest(c)
+	ssIndexCacheMu.Lock()
+	ssIndexCache = make(map[string]*ssIndexCacheEntry)
+	ssIndexCacheMu.Unlock()
+	ssCacheMu.Lock()
+	ssCache = make(map[string]*ssCacheEntry)
+	ssCacheMu.Unlock()
+}
+
+func (s *imageSuite) TestFindInstanceSpecMatchesVirtTypeAndStorage(c *C) {
+	tree := newFakeSimplestreamsTree(fakeIndexJSON, fakeProductsJSON)
+	defer tree.Close()
+	origHost := imagesHost
+	imagesHost = tree.server.URL
+	defer func() { imagesHost = origHost }()
+
+	spec, err := findInstanceSpec(&instanceConstraint{
+		series:   "trusty",
+		arch:     "amd64",
+		region:   "us-east-1",
+		virtType: "hvm",
+		storage:  "ebs",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(spec.imageId, Equals, "ami-hvmebs")
+
+	spec, err = findInstanceSpec(&instanceConstraint{
+		series:   "trusty",
+		arch:     "amd64",
+		region:   "us-east-1",
+		virtType: "pv",
+		storage:  "instance-store",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(spec.imageId, Equals, "ami-pvinstance")
+}
+
+func (s *imageSuite) TestFetchIndexUsesCacheOnNotModified(c *C) {
+	tree := newFakeSimplestreamsTree(fakeIndexJSON, fakeProductsJSON)
+	defer tree.Close()
+
+	index1, err := fetchIndex(tree.server.URL)
+	c.Assert(err, IsNil)
+	index2, err := fetchIndex(tree.server.URL)
+	c.Assert(err, IsNil)
+
+	c.Assert(index2, Equals, index1)
+	c.Assert(tree.indexHits, Equals, 2)
+}
+
+func (s *imageSuite) TestFetchSimplestreamsProductsUsesCacheOnNotModified(c *C) {
+	tree := newFakeSimplestreamsTree(fakeIndexJSON, fakeProductsJSON)
+	defer tree.Close()
+
+	products1, err := fetchSimplestreamsProducts(tree.server.URL, "trusty")
+	c.Assert(err, IsNil)
+	products2, err := fetchSimplestreamsProducts(tree.server.URL, "trusty")
+	c.Assert(err, IsNil)
+
+	c.Assert(products2, Equals, products1)
+	c.Assert(tree.productsHits, Equals, 2)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Authorizer decides whether the current caller may read or write a
+// given payload, identified by the tag of the unit that owns it and
+// the payload's name. It is consulted for every doc returned by a
+// listing and for every Track/Untrack/SetStatus call.
+type Authorizer interface {
+	// CanRead reports whether the caller may see the named payload.
+	CanRead(unitTag, name string) bool
+
+	// CanWrite reports whether the caller may track, untrack, or
+	// change the status of the named payload.
+	CanWrite(unitTag, name string) bool
+}
+
+// PairLister is an optional capability of an Authorizer. When the
+// caller's visibility can be expressed as a static list of allowed
+// (unit, name) pairs, the queries push that list down into the mongo
+// query as a "$or" filter, rather than fetching every doc and
+// filtering with CanRead afterwards.
+type PairLister interface {
+	// AllowedPairs returns the (unit, name) pairs the caller may
+	// read, or ok=false if the set can't be enumerated up front (in
+	// which case CanRead is used to filter after the fetch).
+	AllowedPairs() (pairs []UnitPayload, ok bool)
+}
+
+// UnitPayload names a payload by the unit tag that owns it.
+type UnitPayload struct {
+	UnitTag string
+	Name    string
+}
+
+// permitAllAuthorizer is the default Authorizer, preserving the
+// historical behavior of every caller seeing and changing every
+// payload.
+type permitAllAuthorizer struct{}
+
+// CanRead implements Authorizer.
+func (permitAllAuthorizer) CanRead(unitTag, name string) bool { return true }
+
+// CanWrite implements Authorizer.
+func (permitAllAuthorizer) CanWrite(unitTag, name string) bool { return true }
+
+// readFilter builds the mongo query for docs matching unit (if set)
+// and, when the authorizer supports it, restricted to the caller's
+// allowed pairs.
+func readFilter(unit string, authorizer Authorizer) bson.M {
+	filter := bson.M{}
+	if unit != "" {
+		filter["unitid"] = unit
+	}
+	lister, ok := authorizer.(PairLister)
+	if !ok {
+		return filter
+	}
+	pairs, ok := lister.AllowedPairs()
+	if !ok {
+		return filter
+	}
+	if len(pairs) == 0 {
+		// The caller may read nothing at all. Mongo rejects an empty
+		// "$or", so spell "match nothing" as a filter no document can
+		// ever satisfy instead of an empty list of alternatives.
+		filter["_id"] = bson.M{"$exists": false}
+		return filter
+	}
+	ors := make([]bson.M, len(pairs))
+	for i, p := range pairs {
+		ors[i] = bson.M{"unitid": p.UnitTag, "name": p.Name}
+	}
+	filter["$or"] = ors
+	return filter
+}
+
+// filterReadable drops any record the authorizer won't let the caller
+// see. It's a backstop for authorizers that can't express their
+// allowed set as a query filter.
+func filterReadable(records []payloadRecord, authorizer Authorizer) []payloadRecord {
+	allowed := records[:0]
+	for _, record := range records {
+		if authorizer.CanRead(record.UnitID, record.Name) {
+			allowed = append(allowed, record)
+		}
+	}
+	return allowed
+}
@@ -15,13 +15,22 @@ type EnvPersistence struct {
 	q payloadsQueries
 }
 
-// NewEnvPersistence wraps the "db" in a new EnvPersistence.
+// NewEnvPersistence wraps the "db" in a new EnvPersistence. Every
+// payload is visible and writable by default; use
+// NewEnvPersistenceWithAuthorizer to restrict that.
 func NewEnvPersistence(db PersistenceBase) *EnvPersistence {
-	queries := payloadsQueries{
-		q: db,
-	}
+	return NewEnvPersistenceWithAuthorizer(db, permitAllAuthorizer{})
+}
+
+// NewEnvPersistenceWithAuthorizer wraps the "db" in a new
+// EnvPersistence whose listings are restricted to what authorizer
+// permits.
+func NewEnvPersistenceWithAuthorizer(db PersistenceBase, authorizer Authorizer) *EnvPersistence {
 	return &EnvPersistence{
-		q: queries,
+		q: payloadsQueries{
+			q:          db,
+			authorizer: authorizer,
+		},
 	}
 }
 
@@ -41,3 +50,25 @@ func (ep *EnvPersistence) ListAll() ([]payload.FullPayloadInfo, error) {
 	}
 	return fullPayloads, nil
 }
+
+// ListBySelector returns the payloads in the environment whose labels
+// match every key/value pair in selector. An empty selector is
+// equivalent to ListAll.
+func (ep *EnvPersistence) ListBySelector(selector map[string]string) ([]payload.FullPayloadInfo, error) {
+	logger.Tracef("listing payloads matching %v", selector)
+	if len(selector) == 0 {
+		return ep.ListAll()
+	}
+
+	docs, err := ep.q.bySelector(selector)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var fullPayloads []payload.FullPayloadInfo
+	for _, doc := range docs {
+		p := doc.payload()
+		fullPayloads = append(fullPayloads, p)
+	}
+	return fullPayloads, nil
+}
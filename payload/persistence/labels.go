@@ -0,0 +1,61 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const annotationsC = "annotations"
+
+// annotationsLabelIndexes are the mgo indexes that should be created
+// on the annotations collection so that ListBySelector queries against
+// commonly-tagged label keys don't force a full collection scan. Mongo
+// only uses an index on a dotted subfield for an equality query
+// against that same subfield - an index on "labels" as a whole doesn't
+// serve a "labels.app" query - so these index the individual keys
+// bySelector is actually queried against, not the map field itself.
+// The owning state package is responsible for actually creating these
+// against the collection.
+var annotationsLabelIndexes = []mgo.Index{{
+	Key: []string{"labels.app"},
+}, {
+	Key: []string{"labels.role"},
+}}
+
+// payloadLabelsDoc holds a payload's key/value tags (e.g. "app" ->
+// "postgres"), stored in the shared "annotations" collection as a map
+// so that ListBySelector can query individual "labels.<key>"
+// subfields instead of scanning every document.
+type payloadLabelsDoc struct {
+	DocID string `bson:"_id"`
+
+	Labels map[string]string `bson:"labels"`
+}
+
+// labelsInsertOps returns the op to record a payload's labels. It's
+// only needed when the payload actually has labels to store.
+func labelsInsertOps(payloadID string, labels map[string]string) []txn.Op {
+	return []txn.Op{{
+		C:      annotationsC,
+		Id:     payloadID,
+		Assert: txn.DocMissing,
+		Insert: &payloadLabelsDoc{
+			DocID:  payloadID,
+			Labels: labels,
+		},
+	}}
+}
+
+// labelsRemoveOps returns the op to remove a payload's labels doc. It
+// should only be used when the payload is known to have one.
+func labelsRemoveOps(payloadID string) []txn.Op {
+	return []txn.Op{{
+		C:      annotationsC,
+		Id:     payloadID,
+		Assert: txn.DocExists,
+		Remove: true,
+	}}
+}
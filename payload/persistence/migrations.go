@@ -0,0 +1,58 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// legacyPayloadDoc mirrors the pre-split payloadDoc shape, with status
+// and labels still embedded, so MigrateStatusAndLabels can read
+// documents written before this collection split.
+type legacyPayloadDoc struct {
+	DocID  string            `bson:"_id"`
+	State  string            `bson:"state"`
+	Labels map[string]string `bson:"labels"`
+}
+
+// MigrateStatusAndLabels is a one-time upgrade step: it reads every
+// payload doc's embedded State and Labels fields (as they were stored
+// before status and labels moved to the "statuses" and "annotations"
+// collections) and writes the equivalent statuses and annotations
+// docs, so existing payloads keep their status and labels across the
+// upgrade. It's idempotent - a payload that already has a statuses doc
+// is left alone - so it's safe to run more than once.
+func MigrateStatusAndLabels(base PersistenceBase) error {
+	var legacyDocs []legacyPayloadDoc
+	if err := base.All(payloadsC, bson.D{}, &legacyDocs); err != nil {
+		return errors.Trace(err)
+	}
+
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var ops []txn.Op
+		for _, doc := range legacyDocs {
+			if doc.State == "" {
+				continue
+			}
+			var existing []payloadStatusDoc
+			query := bson.D{{"_id", doc.DocID}}
+			if err := base.All(statusesC, query, &existing); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if len(existing) > 0 {
+				// Already migrated.
+				continue
+			}
+
+			ops = append(ops, statusInsertOps(doc.DocID, doc.State)...)
+			if len(doc.Labels) > 0 {
+				ops = append(ops, labelsInsertOps(doc.DocID, doc.Labels)...)
+			}
+		}
+		return ops, nil
+	}
+	return errors.Trace(base.Run(buildTxn))
+}
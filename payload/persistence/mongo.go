@@ -5,8 +5,11 @@ package persistence
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/mgo.v2"
 
 	"github.com/juju/juju/payload"
 )
@@ -15,11 +18,23 @@ const (
 	payloadsC = "payloads"
 )
 
+// payloadsIndexes are the mgo indexes that should be created on the
+// payloads collection so that per-unit listings don't force a full
+// collection scan. The owning state package is responsible for
+// actually creating these against the collection.
+var payloadsIndexes = []mgo.Index{{
+	Key: []string{"unitid"},
+}}
+
 func payloadID(unit, name string) string {
 	return fmt.Sprintf("payload#%s#%s", unit, name)
 }
 
-// payloadDoc is the top-level document for payloads.
+// payloadDoc is the top-level document for payloads. It holds only
+// the payload's identity and type; its status lives in the "statuses"
+// collection and its labels in "annotations" (see statuses.go and
+// labels.go), the same way units' and applications' status and
+// annotations do.
 type payloadDoc struct {
 	DocID string `bson:"_id"`
 
@@ -34,14 +49,6 @@ type payloadDoc struct {
 
 	Type string `bson:"type"`
 
-	// TODO(ericsnow) Store status in the "statuses" collection?
-
-	State string `bson:"state"`
-
-	// TODO(ericsnow) Store labels in the "annotations" collection?
-
-	Labels []string `bson:"labels"`
-
 	RawID string `bson:"rawid"`
 }
 
@@ -50,9 +57,6 @@ func newPayloadDoc(stID string, p payload.FullPayloadInfo) *payloadDoc {
 
 	definition := p.PayloadClass
 
-	labels := make([]string, len(p.Labels))
-	copy(labels, p.Labels)
-
 	return &payloadDoc{
 		DocID:  id,
 		UnitID: p.Unit,
@@ -64,26 +68,32 @@ func newPayloadDoc(stID string, p payload.FullPayloadInfo) *payloadDoc {
 
 		Type: definition.Type,
 
-		State: p.Status,
-
-		Labels: labels,
-
 		RawID: p.ID,
 	}
 }
 
-func (d payloadDoc) payload() payload.FullPayloadInfo {
-	labels := make([]string, len(d.Labels))
-	copy(labels, d.Labels)
+// payloadRecord is the composite of a payloadDoc with the status and
+// labels joined in from their own collections, ready to be turned into
+// a payload.FullPayloadInfo.
+type payloadRecord struct {
+	payloadDoc
+
+	Status    string
+	StatusSeq int
+	Labels    map[string]string
+}
+
+func (r payloadRecord) payload() payload.FullPayloadInfo {
+	labels := labelsFromMap(r.Labels)
 	p := payload.FullPayloadInfo{
 		Payload: payload.Payload{
-			PayloadClass: d.definition(),
-			ID:           d.RawID,
-			Status:       d.State,
+			PayloadClass: r.definition(),
+			ID:           r.RawID,
+			Status:       r.Status,
 			Labels:       labels,
-			Unit:         d.UnitID,
+			Unit:         r.UnitID,
 		},
-		Machine: d.MachineID,
+		Machine: r.MachineID,
 	}
 	return p
 }
@@ -105,3 +115,45 @@ func (d payloadDoc) match(name, rawID string) bool {
 	}
 	return true
 }
+
+// labelsToMap turns a payload's "key=value" label strings into the
+// map form stored in the doc. A label with no "=" is stored with an
+// empty value.
+func labelsToMap(raw []string) map[string]string {
+	if len(raw) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(raw))
+	for _, label := range raw {
+		key, value := label, ""
+		if i := strings.Index(label, "="); i >= 0 {
+			key, value = label[:i], label[i+1:]
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// labelsFromMap is the inverse of labelsToMap, producing a
+// deterministically-ordered "key=value" slice.
+func labelsFromMap(labels map[string]string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	raw := make([]string, len(keys))
+	for i, key := range keys {
+		value := labels[key]
+		if value == "" {
+			raw[i] = key
+			continue
+		}
+		raw[i] = key + "=" + value
+	}
+	return raw
+}
@@ -0,0 +1,305 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	jujutxn "github.com/juju/txn"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+
+	"github.com/juju/juju/payload"
+)
+
+// PersistenceBase exposes the persistence functionality needed by the
+// payloads layer. It is deliberately small so that it can be backed
+// either by a real mongo-backed *state.State or a stub in tests.
+type PersistenceBase interface {
+	// All populates docs with the list of documents matching the query.
+	All(collName string, query, docs interface{}) error
+	// Run runs the transaction generated by the provided factory
+	// function, retrying as needed if an assertion fails.
+	Run(transactions jujutxn.TransactionSource) error
+}
+
+// payloadsQueries knows how to read and build transactions against
+// the payloads, statuses and annotations collections. It is shared by
+// both the environment-wide EnvPersistence and the per-unit
+// Persistence.
+type payloadsQueries struct {
+	q          PersistenceBase
+	authorizer Authorizer
+}
+
+// run runs the given transaction source against the underlying base.
+func (pq payloadsQueries) run(buildTxn jujutxn.TransactionSource) error {
+	return pq.q.Run(buildTxn)
+}
+
+func (pq payloadsQueries) all(unit string) ([]payloadRecord, error) {
+	query := readFilter(unit, pq.authorizer)
+	var docs []payloadDoc
+	if err := pq.q.All(payloadsC, query, &docs); err != nil {
+		return nil, errors.Trace(err)
+	}
+	records, err := pq.join(docs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return filterReadable(records, pq.authorizer), nil
+}
+
+// bySelector returns the docs whose labels match every key/value pair
+// in the selector.
+func (pq payloadsQueries) bySelector(selector map[string]string) ([]payloadRecord, error) {
+	labelQuery := bson.M{}
+	for key, value := range selector {
+		labelQuery[fmt.Sprintf("labels.%s", key)] = value
+	}
+	var labelDocs []payloadLabelsDoc
+	if err := pq.q.All(annotationsC, labelQuery, &labelDocs); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(labelDocs) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, len(labelDocs))
+	labelsByID := make(map[string]map[string]string, len(labelDocs))
+	for i, doc := range labelDocs {
+		ids[i] = doc.DocID
+		labelsByID[doc.DocID] = doc.Labels
+	}
+
+	query := readFilter("", pq.authorizer)
+	query["_id"] = bson.M{"$in": ids}
+	var docs []payloadDoc
+	if err := pq.q.All(payloadsC, query, &docs); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	statuses, err := pq.fetchStatuses(docIDs(docs))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	records := joinRecords(docs, statuses, labelsByID)
+	return filterReadable(records, pq.authorizer), nil
+}
+
+func (pq payloadsQueries) byID(id string) (payloadDoc, error) {
+	var docs []payloadDoc
+	query := bson.D{{"_id", id}}
+	if err := pq.q.All(payloadsC, query, &docs); err != nil {
+		return payloadDoc{}, errors.Trace(err)
+	}
+	if len(docs) == 0 {
+		return payloadDoc{}, errors.NotFoundf("payload %q", id)
+	}
+	return docs[0], nil
+}
+
+// join reads the statuses and labels joined to docs by payload ID.
+func (pq payloadsQueries) join(docs []payloadDoc) ([]payloadRecord, error) {
+	ids := docIDs(docs)
+	statuses, err := pq.fetchStatuses(ids)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	labels, err := pq.fetchLabels(ids)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return joinRecords(docs, statuses, labels), nil
+}
+
+func (pq payloadsQueries) fetchStatuses(ids []string) (map[string]payloadStatusDoc, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var docs []payloadStatusDoc
+	query := bson.M{"_id": bson.M{"$in": ids}}
+	if err := pq.q.All(statusesC, query, &docs); err != nil {
+		return nil, errors.Trace(err)
+	}
+	byID := make(map[string]payloadStatusDoc, len(docs))
+	for _, doc := range docs {
+		byID[doc.DocID] = doc
+	}
+	return byID, nil
+}
+
+func (pq payloadsQueries) fetchLabels(ids []string) (map[string]map[string]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var docs []payloadLabelsDoc
+	query := bson.M{"_id": bson.M{"$in": ids}}
+	if err := pq.q.All(annotationsC, query, &docs); err != nil {
+		return nil, errors.Trace(err)
+	}
+	byID := make(map[string]map[string]string, len(docs))
+	for _, doc := range docs {
+		byID[doc.DocID] = doc.Labels
+	}
+	return byID, nil
+}
+
+// docIDs returns the _id of each doc, for use as an "$in" filter
+// against the statuses and annotations collections.
+func docIDs(docs []payloadDoc) []string {
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.DocID
+	}
+	return ids
+}
+
+// joinRecords combines identity docs with their looked-up statuses and
+// labels. A doc with no matching status (shouldn't normally happen,
+// since every tracked payload has one) ends up with an empty status.
+func joinRecords(docs []payloadDoc, statuses map[string]payloadStatusDoc, labels map[string]map[string]string) []payloadRecord {
+	records := make([]payloadRecord, len(docs))
+	for i, doc := range docs {
+		status := statuses[doc.DocID]
+		records[i] = payloadRecord{
+			payloadDoc: doc,
+			Status:     status.Status,
+			StatusSeq:  status.Seq,
+			Labels:     labels[doc.DocID],
+		}
+	}
+	return records
+}
+
+// insertOps returns the txn.Ops needed to track a single payload,
+// along with the underlying "already exists" problem (if any) so the
+// caller can surface a more meaningful error than a bare DocMissing
+// assertion failure.
+func (pq payloadsQueries) insertOps(stID string, pl payload.FullPayloadInfo) ([]txn.Op, error) {
+	if !pq.authorizer.CanWrite(pl.Unit, pl.Name) {
+		return nil, errors.Unauthorizedf("cannot track payload %q", pl.Name)
+	}
+	id := payloadID(pl.Unit, pl.Name)
+	existing, err := pq.byID(id)
+	if err == nil {
+		if existing.StateID == stID {
+			return nil, errors.Trace(payload.ErrAlreadyExists)
+		}
+		return nil, errors.AlreadyExistsf("payload %q", id)
+	} else if !errors.IsNotFound(err) {
+		return nil, errors.Trace(err)
+	}
+
+	ops := []txn.Op{{
+		C:      payloadsC,
+		Id:     id,
+		Assert: txn.DocMissing,
+		Insert: newPayloadDoc(stID, pl),
+	}}
+	ops = append(ops, statusInsertOps(id, pl.Status)...)
+	if labels := labelsToMap(pl.Labels); len(labels) > 0 {
+		ops = append(ops, labelsInsertOps(id, labels)...)
+	}
+	return ops, nil
+}
+
+// setStatusOps returns the txn.Ops to update the status of the
+// already-looked-up doc, asserting that it's still tracked under the
+// same state ID.
+func (pq payloadsQueries) setStatusOps(doc payloadRecord, status string) ([]txn.Op, error) {
+	if !pq.authorizer.CanWrite(doc.UnitID, doc.Name) {
+		return nil, errors.Unauthorizedf("cannot set status of payload %q", doc.Name)
+	}
+	ops := statusUpdateOps(doc.DocID, status, doc.StatusSeq+1)
+	ops = append(ops, txn.Op{
+		C:      payloadsC,
+		Id:     doc.DocID,
+		Assert: bson.D{{"state-id", doc.StateID}},
+	})
+	return ops, nil
+}
+
+// removeOps returns the txn.Ops to remove the already-looked-up doc,
+// asserting that it's still tracked under the same state ID. Its
+// status history is left in place.
+func (pq payloadsQueries) removeOps(doc payloadRecord) ([]txn.Op, error) {
+	if !pq.authorizer.CanWrite(doc.UnitID, doc.Name) {
+		return nil, errors.Unauthorizedf("cannot untrack payload %q", doc.Name)
+	}
+	ops := []txn.Op{{
+		C:      payloadsC,
+		Id:     doc.DocID,
+		Assert: txn.DocExists,
+		Remove: true,
+	}}
+	ops = append(ops, statusRemoveOps(doc.DocID)...)
+	if len(doc.Labels) > 0 {
+		ops = append(ops, labelsRemoveOps(doc.DocID)...)
+	}
+	ops = append(ops, txn.Op{
+		C:      payloadsC,
+		Id:     doc.DocID,
+		Assert: bson.D{{"state-id", doc.StateID}},
+	})
+	return ops, nil
+}
+
+// lookUp finds the doc whose StateID matches the given state ID. It
+// isn't restricted by CanRead, so the write paths that use it report a
+// denied write (via CanWrite) rather than a missing payload.
+func (pq payloadsQueries) lookUp(stID string) (payloadRecord, error) {
+	var found []payloadDoc
+	if err := pq.q.All(payloadsC, bson.M{}, &found); err != nil {
+		return payloadRecord{}, errors.Trace(err)
+	}
+	docs, err := pq.join(found)
+	if err != nil {
+		return payloadRecord{}, errors.Trace(err)
+	}
+	for _, doc := range docs {
+		if doc.StateID == stID {
+			return doc, nil
+		}
+	}
+	return payloadRecord{}, errors.Trace(payload.ErrNotFound)
+}
+
+// insertManyOps returns the combined txn.Ops for tracking several
+// payloads at once, so the whole batch commits or none of it does.
+func (pq payloadsQueries) insertManyOps(stIDs []string, pls []payload.FullPayloadInfo) ([]txn.Op, error) {
+	if len(stIDs) != len(pls) {
+		return nil, errors.Errorf("got %d state IDs but %d payloads", len(stIDs), len(pls))
+	}
+	var ops []txn.Op
+	for i, pl := range pls {
+		insertOps, err := pq.insertOps(stIDs[i], pl)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ops = append(ops, insertOps...)
+	}
+	return ops, nil
+}
+
+// removeManyOps returns the combined txn.Ops for untracking several
+// payloads at once. A state ID with no tracked payload is silently
+// skipped, matching the single-payload Untrack semantics.
+func (pq payloadsQueries) removeManyOps(stIDs []string) ([]txn.Op, error) {
+	var ops []txn.Op
+	for _, stID := range stIDs {
+		doc, err := pq.lookUp(stID)
+		if errors.Cause(err) == payload.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		removeOps, err := pq.removeOps(doc)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ops = append(ops, removeOps...)
+	}
+	return ops, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const (
+	statusesC        = "statuses"
+	statusesHistoryC = "statuseshistory"
+)
+
+// payloadStatusDoc is the current status of a payload, stored in the
+// shared "statuses" collection - the same one units and applications
+// use - so a payload's status can be inspected alongside theirs.
+type payloadStatusDoc struct {
+	DocID string `bson:"_id"`
+
+	Status string `bson:"status"`
+
+	// Seq counts the status transitions recorded for this payload, so
+	// each one gets a unique, ordered entry in statusesHistoryC.
+	Seq int `bson:"seq"`
+}
+
+// payloadStatusHistoryDoc records a single status transition. Unlike
+// payloadStatusDoc, history entries are never removed when the
+// payload is untracked, so the transition history survives it.
+type payloadStatusHistoryDoc struct {
+	DocID string `bson:"_id"`
+
+	PayloadID string `bson:"payloadid"`
+	Status    string `bson:"status"`
+	Seq       int    `bson:"seq"`
+}
+
+func statusHistoryID(payloadID string, seq int) string {
+	return fmt.Sprintf("%s#history#%d", payloadID, seq)
+}
+
+// statusInsertOps returns the ops to record a payload's initial status
+// (seq 0) alongside its first history entry.
+func statusInsertOps(payloadID, status string) []txn.Op {
+	return []txn.Op{{
+		C:      statusesC,
+		Id:     payloadID,
+		Assert: txn.DocMissing,
+		Insert: &payloadStatusDoc{
+			DocID:  payloadID,
+			Status: status,
+		},
+	}, {
+		C:      statusesHistoryC,
+		Id:     statusHistoryID(payloadID, 0),
+		Assert: txn.DocMissing,
+		Insert: &payloadStatusHistoryDoc{
+			DocID:     statusHistoryID(payloadID, 0),
+			PayloadID: payloadID,
+			Status:    status,
+		},
+	}}
+}
+
+// statusUpdateOps returns the ops to move a payload's status on to a
+// new value, appending a new history entry at nextSeq.
+func statusUpdateOps(payloadID, status string, nextSeq int) []txn.Op {
+	return []txn.Op{{
+		C:      statusesC,
+		Id:     payloadID,
+		Assert: txn.DocExists,
+		Update: bson.D{
+			{"$set", bson.D{
+				{"status", status},
+				{"seq", nextSeq},
+			}},
+		},
+	}, {
+		C:      statusesHistoryC,
+		Id:     statusHistoryID(payloadID, nextSeq),
+		Assert: txn.DocMissing,
+		Insert: &payloadStatusHistoryDoc{
+			DocID:     statusHistoryID(payloadID, nextSeq),
+			PayloadID: payloadID,
+			Status:    status,
+			Seq:       nextSeq,
+		},
+	}}
+}
+
+// statusRemoveOps returns the op to remove a payload's current status.
+// Its history is left alone, so status transitions remain queryable
+// even after the payload itself is untracked.
+func statusRemoveOps(payloadID string) []txn.Op {
+	return []txn.Op{{
+		C:      statusesC,
+		Id:     payloadID,
+		Assert: txn.DocExists,
+		Remove: true,
+	}}
+}
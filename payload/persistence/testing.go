@@ -0,0 +1,333 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	jujutxn "github.com/juju/txn"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+
+	"github.com/juju/juju/payload"
+)
+
+// PayloadDoc, PayloadStatusDoc, PayloadStatusHistoryDoc and
+// PayloadLabelsDoc are exported for use in the persistence tests,
+// which live in an external "persistence_test" package.
+type PayloadDoc = payloadDoc
+type PayloadStatusDoc = payloadStatusDoc
+type PayloadStatusHistoryDoc = payloadStatusHistoryDoc
+type PayloadLabelsDoc = payloadLabelsDoc
+
+// BaseSuite provides the fixtures used by the payload persistence
+// tests: a stub PersistenceBase (Stub, State) and convenience
+// constructors for payloads and their backing docs.
+type BaseSuite struct {
+	testing.IsolationSuite
+
+	Stub  *testing.Stub
+	State *StubPersistenceBase
+}
+
+// SetUpTest implements the usual gocheck fixture contract.
+func (s *BaseSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+
+	s.Stub = &testing.Stub{}
+	s.State = NewStubPersistenceBase(s.Stub)
+}
+
+// NewPersistence returns a Persistence wrapping the suite's stub base.
+func (s *BaseSuite) NewPersistence() *Persistence {
+	return NewPersistence(s.State)
+}
+
+// NewPersistenceWithAuthorizer returns a Persistence wrapping the
+// suite's stub base, restricted by the given authorizer.
+func (s *BaseSuite) NewPersistenceWithAuthorizer(authorizer Authorizer) *Persistence {
+	return NewPersistenceWithAuthorizer(s.State, authorizer)
+}
+
+// NewPayload builds a payload.FullPayloadInfo of the given type, with
+// a "<name>/<rawid>" identifier, owned by "a-unit/0" on machine "0".
+func (s *BaseSuite) NewPayload(pType, id string) payload.FullPayloadInfo {
+	name, rawID := splitPayloadID(id)
+	return payload.FullPayloadInfo{
+		Payload: payload.Payload{
+			PayloadClass: charm.PayloadClass{
+				Name: name,
+				Type: pType,
+			},
+			ID:     rawID,
+			Status: payload.StateRunning,
+			Unit:   "a-unit/0",
+		},
+		Machine: "0",
+	}
+}
+
+// NewPayloads builds several payloads at once, one per "name/rawid" id.
+func (s *BaseSuite) NewPayloads(pType string, ids ...string) []payload.FullPayloadInfo {
+	payloads := make([]payload.FullPayloadInfo, len(ids))
+	for i, id := range ids {
+		payloads[i] = s.NewPayload(pType, id)
+	}
+	return payloads
+}
+
+// SetDoc pre-populates the stub backing with a doc for the payload,
+// tracked under the given state ID.
+func (s *BaseSuite) SetDoc(stID string, pl payload.FullPayloadInfo) {
+	s.State.SetDoc(stID, pl)
+}
+
+// StubAuthorizer is a stub Authorizer for use in the payload
+// persistence tests. A nil Allowed denies every read and write.
+type StubAuthorizer struct {
+	// Allowed, if set, is the set of "unit/name" pairs that may be
+	// read or written. Anything else is denied.
+	Allowed map[string]bool
+
+	// Pairs and PairsOK back AllowedPairs, giving the stub an opt-in
+	// PairLister capability for tests that need one.
+	Pairs   []UnitPayload
+	PairsOK bool
+}
+
+// CanRead implements Authorizer.
+func (a StubAuthorizer) CanRead(unitTag, name string) bool {
+	return a.Allowed[unitTag+"/"+name]
+}
+
+// CanWrite implements Authorizer.
+func (a StubAuthorizer) CanWrite(unitTag, name string) bool {
+	return a.Allowed[unitTag+"/"+name]
+}
+
+// AllowedPairs implements PairLister.
+func (a StubAuthorizer) AllowedPairs() ([]UnitPayload, bool) {
+	return a.Pairs, a.PairsOK
+}
+
+func splitPayloadID(id string) (name, rawID string) {
+	for i := 0; i < len(id); i++ {
+		if id[i] == '/' {
+			return id[:i], id[i+1:]
+		}
+	}
+	return id, ""
+}
+
+// StubPersistenceBase is a stub PersistenceBase backed by in-memory
+// maps, one per collection, for use in the payload persistence tests.
+type StubPersistenceBase struct {
+	stub *testing.Stub
+
+	payloads      map[string]payloadDoc
+	statuses      map[string]payloadStatusDoc
+	statusHistory map[string]payloadStatusHistoryDoc
+	labels        map[string]payloadLabelsDoc
+
+	ops [][]txn.Op
+}
+
+// NewStubPersistenceBase returns a new StubPersistenceBase recording
+// its calls on the given stub.
+func NewStubPersistenceBase(stub *testing.Stub) *StubPersistenceBase {
+	return &StubPersistenceBase{
+		stub:          stub,
+		payloads:      make(map[string]payloadDoc),
+		statuses:      make(map[string]payloadStatusDoc),
+		statusHistory: make(map[string]payloadStatusHistoryDoc),
+		labels:        make(map[string]payloadLabelsDoc),
+	}
+}
+
+// SetDoc adds a doc (and matching status and, if any, labels docs) for
+// the payload, as though it had previously been tracked under the
+// given state ID.
+func (s *StubPersistenceBase) SetDoc(stID string, pl payload.FullPayloadInfo) {
+	doc := newPayloadDoc(stID, pl)
+	s.payloads[doc.DocID] = *doc
+	s.statuses[doc.DocID] = payloadStatusDoc{DocID: doc.DocID, Status: pl.Status}
+	if labels := labelsToMap(pl.Labels); len(labels) > 0 {
+		s.labels[doc.DocID] = payloadLabelsDoc{DocID: doc.DocID, Labels: labels}
+	}
+}
+
+// CheckOps compares the transactions applied over the life of the
+// stub against the expected ones.
+func (s *StubPersistenceBase) CheckOps(c *gc.C, expected [][]txn.Op) {
+	c.Check(s.ops, jc.DeepEquals, expected)
+}
+
+// CheckNoOps verifies that no transaction was ever successfully applied.
+func (s *StubPersistenceBase) CheckNoOps(c *gc.C) {
+	c.Check(s.ops, gc.HasLen, 0)
+}
+
+// All implements PersistenceBase. It ignores query, returning every
+// doc in the named collection - the stub leaves query-based filtering
+// (e.g. by unit or label) to the caller, same as it leaves
+// authorization filtering to payloadsQueries.
+func (s *StubPersistenceBase) All(collName string, query, docsOut interface{}) error {
+	s.stub.AddCall("All", collName, query)
+	if err := s.stub.NextErr(); err != nil {
+		return err
+	}
+
+	switch collName {
+	case payloadsC:
+		out, ok := docsOut.(*[]payloadDoc)
+		if !ok {
+			return errors.Errorf("unsupported docs type %T", docsOut)
+		}
+		for _, doc := range s.payloads {
+			*out = append(*out, doc)
+		}
+	case statusesC:
+		out, ok := docsOut.(*[]payloadStatusDoc)
+		if !ok {
+			return errors.Errorf("unsupported docs type %T", docsOut)
+		}
+		for _, doc := range s.statuses {
+			*out = append(*out, doc)
+		}
+	case annotationsC:
+		out, ok := docsOut.(*[]payloadLabelsDoc)
+		if !ok {
+			return errors.Errorf("unsupported docs type %T", docsOut)
+		}
+		for _, doc := range s.labels {
+			*out = append(*out, doc)
+		}
+	default:
+		return errors.Errorf("unknown collection %q", collName)
+	}
+	return nil
+}
+
+// Run implements PersistenceBase, applying the built ops directly
+// against the in-memory doc maps and recording them for CheckOps. An
+// error queued on the stub is consumed only once the transaction
+// source has built a non-empty set of ops, and is returned in place of
+// applying them; errors queued earlier go to the All calls the
+// transaction source makes.
+func (s *StubPersistenceBase) Run(transactions jujutxn.TransactionSource) error {
+	s.stub.AddCall("Run")
+
+	for attempt := 0; ; attempt++ {
+		ops, err := transactions(attempt)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		if err := s.stub.NextErr(); err != nil {
+			return err
+		}
+		if err := s.applyOps(ops); err != nil {
+			if err == txn.ErrAborted && attempt == 0 {
+				continue
+			}
+			return err
+		}
+		s.ops = append(s.ops, ops)
+		return nil
+	}
+}
+
+func (s *StubPersistenceBase) applyOps(ops []txn.Op) error {
+	for _, op := range ops {
+		id, _ := op.Id.(string)
+		var exists bool
+		switch op.C {
+		case payloadsC:
+			_, exists = s.payloads[id]
+		case statusesC:
+			_, exists = s.statuses[id]
+		case statusesHistoryC:
+			_, exists = s.statusHistory[id]
+		case annotationsC:
+			_, exists = s.labels[id]
+		}
+		switch op.Assert {
+		case txn.DocMissing:
+			if exists {
+				return txn.ErrAborted
+			}
+		case txn.DocExists:
+			if !exists {
+				return txn.ErrAborted
+			}
+		}
+	}
+	for _, op := range ops {
+		id, _ := op.Id.(string)
+		switch op.C {
+		case payloadsC:
+			switch {
+			case op.Insert != nil:
+				s.payloads[id] = *(op.Insert.(*payloadDoc))
+			case op.Remove:
+				delete(s.payloads, id)
+			}
+		case statusesC:
+			switch {
+			case op.Insert != nil:
+				s.statuses[id] = *(op.Insert.(*payloadStatusDoc))
+			case op.Remove:
+				delete(s.statuses, id)
+			case op.Update != nil:
+				doc := s.statuses[id]
+				applyStatusUpdate(&doc, op.Update)
+				s.statuses[id] = doc
+			}
+		case statusesHistoryC:
+			if op.Insert != nil {
+				s.statusHistory[id] = *(op.Insert.(*payloadStatusHistoryDoc))
+			}
+		case annotationsC:
+			switch {
+			case op.Insert != nil:
+				s.labels[id] = *(op.Insert.(*payloadLabelsDoc))
+			case op.Remove:
+				delete(s.labels, id)
+			}
+		}
+	}
+	return nil
+}
+
+// applyStatusUpdate applies the {"$set": {"status": ..., "seq": ...}}
+// update used by statusUpdateOps. Other shapes are ignored, since
+// that's the only update the statuses collection currently issues.
+func applyStatusUpdate(doc *payloadStatusDoc, update interface{}) {
+	d, ok := update.(bson.D)
+	if !ok {
+		return
+	}
+	for _, elem := range d {
+		if elem.Name != "$set" {
+			continue
+		}
+		set, ok := elem.Value.(bson.D)
+		if !ok {
+			continue
+		}
+		for _, field := range set {
+			switch field.Name {
+			case "status":
+				doc.Status, _ = field.Value.(string)
+			case "seq":
+				doc.Seq, _ = field.Value.(int)
+			}
+		}
+	}
+}
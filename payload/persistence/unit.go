@@ -0,0 +1,167 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package persistence
+
+import (
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/txn"
+
+	"github.com/juju/juju/payload"
+)
+
+// Persistence provides the persistence functionality for a unit's
+// payloads.
+type Persistence struct {
+	q payloadsQueries
+}
+
+// NewPersistence wraps the "db" in a new Persistence. Every payload is
+// visible and writable by default; use NewPersistenceWithAuthorizer to
+// restrict that.
+func NewPersistence(db PersistenceBase) *Persistence {
+	return NewPersistenceWithAuthorizer(db, permitAllAuthorizer{})
+}
+
+// NewPersistenceWithAuthorizer wraps the "db" in a new Persistence
+// whose reads and writes are restricted to what authorizer permits.
+func NewPersistenceWithAuthorizer(db PersistenceBase, authorizer Authorizer) *Persistence {
+	return &Persistence{
+		q: payloadsQueries{
+			q:          db,
+			authorizer: authorizer,
+		},
+	}
+}
+
+// Track adds records for the payload to persistence. If the payload
+// is already tracked under the given state ID, Track is a no-op and
+// returns payload.ErrAlreadyExists. If a different payload is already
+// tracked under the same unit/name, it returns an AlreadyExists error.
+func (pp *Persistence) Track(stID string, pl payload.FullPayloadInfo) error {
+	logger.Tracef("tracking %q", pl.Name)
+
+	var ops []txn.Op
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		insertOps, err := pp.q.insertOps(stID, pl)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ops = insertOps
+		return ops, nil
+	}
+	if err := pp.q.run(buildTxn); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// TrackMany adds records for several payloads in a single transaction,
+// so that if any one insert is rejected, none of them are applied.
+func (pp *Persistence) TrackMany(stIDs []string, pls []payload.FullPayloadInfo) error {
+	logger.Tracef("tracking %d payloads", len(pls))
+
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		return pp.q.insertManyOps(stIDs, pls)
+	}
+	if err := pp.q.run(buildTxn); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// SetStatus updates the status for the identified payload.
+// payload.ErrNotFound is returned if the payload is not tracked.
+func (pp *Persistence) SetStatus(stID string, status string) error {
+	logger.Tracef("setting status for %q", stID)
+
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		doc, err := pp.q.lookUp(stID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return pp.q.setStatusOps(doc, status)
+	}
+	if err := pp.q.run(buildTxn); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// List builds the list of payloads registered for the given state
+// IDs. Any that are not found are returned as "missing".
+func (pp *Persistence) List(ids ...string) ([]payload.FullPayloadInfo, []string, error) {
+	logger.Tracef("listing %v", ids)
+
+	docs, err := pp.q.all("")
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	byStateID := make(map[string]payloadRecord, len(docs))
+	for _, doc := range docs {
+		byStateID[doc.StateID] = doc
+	}
+
+	var payloads []payload.FullPayloadInfo
+	var missing []string
+	for _, id := range ids {
+		doc, ok := byStateID[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		payloads = append(payloads, doc.payload())
+	}
+	return payloads, missing, nil
+}
+
+// ListAll returns the list of all payloads registered for the unit.
+func (pp *Persistence) ListAll() ([]payload.FullPayloadInfo, error) {
+	logger.Tracef("listing all payloads")
+
+	docs, err := pp.q.all("")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var payloads []payload.FullPayloadInfo
+	for _, doc := range docs {
+		payloads = append(payloads, doc.payload())
+	}
+	return payloads, nil
+}
+
+// Untrack removes the identified payload from persistence. Untracking
+// a payload that isn't tracked is a no-op.
+func (pp *Persistence) Untrack(stID string) error {
+	logger.Tracef("untracking %q", stID)
+
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		doc, err := pp.q.lookUp(stID)
+		if errors.Cause(err) == payload.ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return pp.q.removeOps(doc)
+	}
+	if err := pp.q.run(buildTxn); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// UntrackMany removes several payloads from persistence in a single
+// transaction. State IDs with no tracked payload are skipped.
+func (pp *Persistence) UntrackMany(stIDs []string) error {
+	logger.Tracef("untracking %d payloads", len(stIDs))
+
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		return pp.q.removeManyOps(stIDs)
+	}
+	if err := pp.q.run(buildTxn); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
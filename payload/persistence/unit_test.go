@@ -46,7 +46,23 @@ func (s *payloadsPersistenceSuite) TestTrackOkay(c *gc.C) {
 				StateID:   stID,
 				Type:      "docker",
 				RawID:     "payloadA-xyz",
-				State:     "running",
+			},
+		}, {
+			C:      "statuses",
+			Id:     id,
+			Assert: txn.DocMissing,
+			Insert: &persistence.PayloadStatusDoc{
+				DocID:  id,
+				Status: "running",
+			},
+		}, {
+			C:      "statuseshistory",
+			Id:     id + "#history#0",
+			Assert: txn.DocMissing,
+			Insert: &persistence.PayloadStatusHistoryDoc{
+				DocID:     id + "#history#0",
+				PayloadID: id,
+				Status:    "running",
 			},
 		},
 	}})
@@ -91,7 +107,6 @@ func (s *payloadsPersistenceSuite) TestTrackNameAlreadyExists(c *gc.C) {
 				StateID:   stID,
 				Type:      "docker",
 				RawID:     "payloadA-xyz",
-				State:     "running",
 			},
 		},
 	}})
@@ -133,17 +148,28 @@ func (s *payloadsPersistenceSuite) TestSetStatusOkay(c *gc.C) {
 	err := pp.SetStatus(stID, payload.StateRunning)
 	c.Assert(err, jc.ErrorIsNil)
 
-	s.Stub.CheckCallNames(c, "Run", "All")
+	s.Stub.CheckCallNames(c, "Run", "All", "All", "All")
 	s.State.CheckOps(c, [][]txn.Op{{
 		{
-			C:      "payloads",
+			C:      "statuses",
 			Id:     id,
 			Assert: txn.DocExists,
 			Update: bson.D{
 				{"$set", bson.D{
-					{"state", payload.StateRunning},
+					{"status", payload.StateRunning},
+					{"seq", 1},
 				}},
 			},
+		}, {
+			C:      "statuseshistory",
+			Id:     id + "#history#1",
+			Assert: txn.DocMissing,
+			Insert: &persistence.PayloadStatusHistoryDoc{
+				DocID:     id + "#history#1",
+				PayloadID: id,
+				Status:    payload.StateRunning,
+				Seq:       1,
+			},
 		}, {
 			C:      "payloads",
 			Id:     id,
@@ -189,7 +215,7 @@ func (s *payloadsPersistenceSuite) TestListOkay(c *gc.C) {
 	payloads, missing, err := pp.List(id)
 	c.Assert(err, jc.ErrorIsNil)
 
-	s.Stub.CheckCallNames(c, "All")
+	s.Stub.CheckCallNames(c, "All", "All", "All")
 	s.State.CheckNoOps(c)
 	c.Check(payloads, jc.DeepEquals, []payload.FullPayloadInfo{pl})
 	c.Check(missing, gc.HasLen, 0)
@@ -207,7 +233,7 @@ func (s *payloadsPersistenceSuite) TestListSomeMissing(c *gc.C) {
 	payloads, missing, err := pp.List(id, missingID)
 	c.Assert(err, jc.ErrorIsNil)
 
-	s.Stub.CheckCallNames(c, "All")
+	s.Stub.CheckCallNames(c, "All", "All", "All")
 	s.State.CheckNoOps(c)
 	c.Check(payloads, jc.DeepEquals, []payload.FullPayloadInfo{pl})
 	c.Check(missing, jc.DeepEquals, []string{missingID})
@@ -245,7 +271,7 @@ func (s *payloadsPersistenceSuite) TestListAllOkay(c *gc.C) {
 	payloads, err := pp.ListAll()
 	c.Assert(err, jc.ErrorIsNil)
 
-	s.Stub.CheckCallNames(c, "All")
+	s.Stub.CheckCallNames(c, "All", "All", "All")
 	s.State.CheckNoOps(c)
 	sort.Sort(byName(payloads))
 	sort.Sort(byName(existing))
@@ -288,13 +314,18 @@ func (s *payloadsPersistenceSuite) TestUntrackOkay(c *gc.C) {
 	err := pp.Untrack(stID)
 	c.Assert(err, jc.ErrorIsNil)
 
-	s.Stub.CheckCallNames(c, "Run", "All")
+	s.Stub.CheckCallNames(c, "Run", "All", "All", "All")
 	s.State.CheckOps(c, [][]txn.Op{{
 		{
 			C:      "payloads",
 			Id:     id,
 			Assert: txn.DocExists,
 			Remove: true,
+		}, {
+			C:      "statuses",
+			Id:     id,
+			Assert: txn.DocExists,
+			Remove: true,
 		}, {
 			C:      "payloads",
 			Id:     id,
@@ -325,3 +356,64 @@ func (s *payloadsPersistenceSuite) TestUntrackFailed(c *gc.C) {
 	c.Check(errors.Cause(err), gc.Equals, failure)
 	s.State.CheckOps(c, nil)
 }
+
+func (s *payloadsPersistenceSuite) TestTrackDeniedWrite(c *gc.C) {
+	pl := s.NewPayload("docker", "payloadA/payloadA-xyz")
+	stID := "f47ac10b-58cc-4372-a567-0e02b2c3d479"
+
+	pp := s.NewPersistenceWithAuthorizer(persistence.StubAuthorizer{})
+	err := pp.Track(stID, pl)
+
+	c.Check(err, jc.Satisfies, errors.IsUnauthorized)
+	s.State.CheckNoOps(c)
+}
+
+func (s *payloadsPersistenceSuite) TestUntrackDeniedWrite(c *gc.C) {
+	id := "f47ac10b-58cc-4372-a567-0e02b2c3d479"
+	pl := s.NewPayload("docker", "payloadA/xyz")
+	s.SetDoc(id, pl)
+
+	pp := s.NewPersistenceWithAuthorizer(persistence.StubAuthorizer{})
+	err := pp.Untrack(id)
+
+	c.Check(err, jc.Satisfies, errors.IsUnauthorized)
+	s.State.CheckNoOps(c)
+}
+
+func (s *payloadsPersistenceSuite) TestListAllDeniedRead(c *gc.C) {
+	s.SetDoc("f47ac10b-58cc-4372-a567-0e02b2c3d479", s.NewPayload("docker", "payloadA/xyz"))
+
+	pp := s.NewPersistenceWithAuthorizer(persistence.StubAuthorizer{})
+	payloads, err := pp.ListAll()
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Check(payloads, gc.HasLen, 0)
+}
+
+func (s *payloadsPersistenceSuite) TestListAllPartialVisibility(c *gc.C) {
+	visible := s.NewPayload("docker", "payloadA/xyz")
+	hidden := s.NewPayload("docker", "payloadB/abc")
+	s.SetDoc("f47ac10b-58cc-4372-a567-0e02b2c3d479", visible)
+	s.SetDoc("f47ac10b-58cc-4372-a567-0e02b2c3d480", hidden)
+
+	authorizer := persistence.StubAuthorizer{
+		Allowed: map[string]bool{"a-unit/0/payloadA": true},
+	}
+	pp := s.NewPersistenceWithAuthorizer(authorizer)
+	payloads, err := pp.ListAll()
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(payloads, gc.HasLen, 1)
+	c.Check(payloads[0].Name, gc.Equals, "payloadA")
+}
+
+func (s *payloadsPersistenceSuite) TestListAllPairListerNoPairs(c *gc.C) {
+	s.SetDoc("f47ac10b-58cc-4372-a567-0e02b2c3d479", s.NewPayload("docker", "payloadA/xyz"))
+
+	authorizer := persistence.StubAuthorizer{PairsOK: true}
+	pp := s.NewPersistenceWithAuthorizer(authorizer)
+	payloads, err := pp.ListAll()
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Check(payloads, gc.HasLen, 0)
+}
@@ -0,0 +1,18 @@
+package rpc
+
+import (
+	"github.com/vmihailenco/msgpack"
+)
+
+// msgpackMarshaler implements Marshaler and Unmarshaler using msgpack,
+// a compact binary encoding well suited to framed transports where we
+// want to avoid JSON's text overhead.
+type msgpackMarshaler struct{}
+
+func (msgpackMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
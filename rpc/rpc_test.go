@@ -134,23 +134,41 @@ func (a *DelayedMethods) Delay() stringVal {
 	return stringVal{<-a.done}
 }
 
+// codecPair names a registered ServerCodec/ClientCodec constructor
+// pair so the suite below can run its tests against every codec the
+// rpc package provides, not just JSON.
+type codecPair struct {
+	name      string
+	newServer func(io.ReadWriteCloser) rpc.ServerCodec
+	newClient func(io.ReadWriteCloser) rpc.ClientCodec
+}
+
+var codecPairs = []codecPair{
+	{"json", func(c io.ReadWriteCloser) rpc.ServerCodec { return NewJSONServerCodec(c) }, func(c io.ReadWriteCloser) rpc.ClientCodec { return NewJSONClientCodec(c) }},
+	{"gob", rpc.NewGobServerCodec, rpc.NewGobClientCodec},
+	{"msgpack", rpc.NewMsgpackServerCodec, rpc.NewMsgpackClientCodec},
+}
+
 func (*suite) TestRPC(c *C) {
-	root := &TRoot{
-		simple: make(map[string]*SimpleMethods),
-	}
-	root.simple["a99"] = &SimpleMethods{root: root, id: "a99"}
-	client, srvDone := newRPCClientServer(c, root)
-	for narg := 0; narg < 2; narg++ {
-		for nret := 0; nret < 2; nret++ {
-			for nerr := 0; nerr < 2; nerr++ {
-				root.calls = nil
-				root.testCall(c, client, narg, nret, nerr != 0)
+	for _, codec := range codecPairs {
+		c.Logf("codec %s", codec.name)
+		root := &TRoot{
+			simple: make(map[string]*SimpleMethods),
+		}
+		root.simple["a99"] = &SimpleMethods{root: root, id: "a99"}
+		client, srvDone := newRPCClientServerCodec(c, root, codec)
+		for narg := 0; narg < 2; narg++ {
+			for nret := 0; nret < 2; nret++ {
+				for nerr := 0; nerr < 2; nerr++ {
+					root.calls = nil
+					root.testCall(c, client, narg, nret, nerr != 0)
+				}
 			}
 		}
+		client.Close()
+		err := <-srvDone
+		c.Assert(err, IsNil)
 	}
-	client.Close()
-	err := <-srvDone
-	c.Assert(err, IsNil)
 }
 
 func (root *TRoot) testCall(c *C, client *rpc.Client, narg, nret int, retErr bool) {
@@ -184,82 +202,95 @@ func (root *TRoot) testCall(c *C, client *rpc.Client, narg, nret int, retErr boo
 }
 
 func (*suite) TestConcurrentCalls(c *C) {
-	start1 := make(chan string)
-	start2 := make(chan string)
-	ready1 := make(chan struct{})
-	ready2 := make(chan struct{})
-
-	root := &TRoot{
-		delayed: map[string]*DelayedMethods{
-			"1": {ready: ready1, done: start1},
-			"2": {ready: ready2, done: start2},
-		},
-	}
+	for _, codec := range codecPairs {
+		c.Logf("codec %s", codec.name)
+		start1 := make(chan string)
+		start2 := make(chan string)
+		ready1 := make(chan struct{})
+		ready2 := make(chan struct{})
+
+		root := &TRoot{
+			delayed: map[string]*DelayedMethods{
+				"1": {ready: ready1, done: start1},
+				"2": {ready: ready2, done: start2},
+			},
+		}
 
-	client, srvDone := newRPCClientServer(c, root)
-	call := func(id string, done chan<- bool) {
-		var r stringVal
-		err := client.Call("DelayedMethods", id, "Delay", nil, &r)
-		c.Check(err, IsNil)
-		c.Check(r.Val, Equals, "return "+id)
-		done <- true
+		client, srvDone := newRPCClientServerCodec(c, root, codec)
+		call := func(id string, done chan<- bool) {
+			var r stringVal
+			err := client.Call("DelayedMethods", id, "Delay", nil, &r)
+			c.Check(err, IsNil)
+			c.Check(r.Val, Equals, "return "+id)
+			done <- true
+		}
+		done1 := make(chan bool)
+		done2 := make(chan bool)
+		go call("1", done1)
+		go call("2", done2)
+
+		// Check that both calls are running concurrently.
+		<-ready1
+		<-ready2
+
+		// Let the requests complete.
+		start1 <- "return 1"
+		start2 <- "return 2"
+		<-done1
+		<-done2
+		client.Close()
+		err := <-srvDone
+		c.Assert(err, IsNil)
 	}
-	done1 := make(chan bool)
-	done2 := make(chan bool)
-	go call("1", done1)
-	go call("2", done2)
-
-	// Check that both calls are running concurrently.
-	<-ready1
-	<-ready2
-
-	// Let the requests complete.
-	start1 <- "return 1"
-	start2 <- "return 2"
-	<-done1
-	<-done2
-	client.Close()
-	err := <-srvDone
-	c.Assert(err, IsNil)
 }
 
 func (*suite) TestServerWaitsForOutstandingCalls(c *C) {
-	ready := make(chan struct{})
-	start := make(chan string)
-	root := &TRoot{
-		delayed: map[string]*DelayedMethods{
-			"1": {
-				ready: ready,
-				done:  start,
+	for _, codec := range codecPairs {
+		c.Logf("codec %s", codec.name)
+		ready := make(chan struct{})
+		start := make(chan string)
+		root := &TRoot{
+			delayed: map[string]*DelayedMethods{
+				"1": {
+					ready: ready,
+					done:  start,
+				},
 			},
-		},
-	}
-	client, srvDone := newRPCClientServer(c, root)
-	done := make(chan bool)
-	go func() {
-		var r stringVal
-		err := client.Call("DelayedMethods", "1", "Delay", nil, &r)
-		c.Check(err, FitsTypeOf, &net.OpError{})
-		done <- true
-	}()
-	<-ready
-	client.Close()
-	select {
-	case err := <-srvDone:
-		c.Fatalf("server returned while outstanding operation in progress: %v", err)
+		}
+		client, srvDone := newRPCClientServerCodec(c, root, codec)
+		done := make(chan bool)
+		go func() {
+			var r stringVal
+			err := client.Call("DelayedMethods", "1", "Delay", nil, &r)
+			c.Check(err, FitsTypeOf, &net.OpError{})
+			done <- true
+		}()
+		<-ready
+		client.Close()
+		select {
+		case err := <-srvDone:
+			c.Fatalf("server returned while outstanding operation in progress: %v", err)
+			<-done
+		case <-time.After(25 * time.Millisecond):
+		}
+		start <- "xxx"
+		err := <-srvDone
+		c.Check(err, IsNil)
 		<-done
-	case <-time.After(25 * time.Millisecond):
 	}
-	start <- "xxx"
-	err := <-srvDone
-	c.Check(err, IsNil)
-	<-done
 }
 
 // newRPCClientServer starts an RPC server serving a connection from a
-// single client.  When the server has finished serving the connection,
-// it sends a value on done.
+// single client, using the JSON codec.  When the server has finished
+// serving the connection, it sends a value on done.
 func newRPCClientServer(c *C, root interface{}) (client *rpc.Client, done <-chan error) {
+	return newRPCClientServerCodec(c, root, codecPairs[0])
+}
+
+// newRPCClientServerCodec is like newRPCClientServer but lets the
+// caller pick which registered codec to wire the client and server
+// together with.
+func newRPCClientServerCodec(c *C, root interface{}, codec codecPair) (client *rpc.Client, done <-chan error) {
 	srv, err := rpc.NewServer(&TRoot{})
 	c.Assert(err, IsNil)
 
@@ -274,13 +305,13 @@ func newRPCClientServer(c *C, root interface{}) (client *rpc.Client, done <-chan
 			srvDone <- err
 			return
 		}
-		err = srv.ServeCodec(NewJSONServerCodec(conn), root)
+		err = srv.ServeCodec(codec.newServer(conn), root)
 		c.Logf("server status: %v", err)
 		srvDone <- err
 	}()
 	conn, err := net.Dial("tcp", l.Addr().String())
 	c.Assert(err, IsNil)
-	client = rpc.NewClientWithCodec(NewJSONClientCodec(conn))
+	client = rpc.NewClientWithCodec(codec.newClient(conn))
 	return client, srvDone
 }
 
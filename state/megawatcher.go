@@ -0,0 +1,1297 @@
+// Copyright 2013 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"container/list"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/tomb"
+
+	"launchpad.net/juju-core/state/api/params"
+	"launchpad.net/juju-core/state/watcher"
+)
+
+// ErrPreconditionFailed is returned by allInfo.updateIfMatch and
+// allInfo.deleteIfMatch when the entry named has moved on from the
+// revno or creationRevno the caller expected, so that the caller can
+// tell a lost race from a successful write rather than silently
+// clobbering a change it never saw.
+var ErrPreconditionFailed = fmt.Errorf("precondition failed")
+
+// ErrWatcherOverflow is returned by StateWatcher.Next when the watcher
+// has fallen too far behind - more than maxPendingRequests calls to
+// Next outstanding at once - and has had that newest request refused
+// rather than be allowed to queue unboundedly, analogous to etcd's
+// compacted-watcher error. The requests already outstanding are left in
+// place.
+var ErrWatcherOverflow = fmt.Errorf("state watcher fell too far behind and was dropped")
+
+// maxPendingRequests bounds how many outstanding allRequests handle
+// will chain for a single watcher before it starts replying
+// ErrWatcherOverflow to new ones, so a watcher that calls Next faster
+// than it's serviced - or simply stops calling it at all - can't pin an
+// unbounded backlog in aw.waiting.
+const maxPendingRequests = 100
+
+// Precondition names a property an allInfo entry must currently have
+// for updateIfMatch or deleteIfMatch to proceed, analogous to an HTTP
+// If-Match header. The zero value matches any entry, including a
+// nonexistent one, so it's safe to pass when no precondition is
+// wanted.
+type Precondition struct {
+	// Revno, if non-zero, requires the entry's current revno - the
+	// value a client would have last seen on a params.Delta - to
+	// equal it.
+	Revno int64
+
+	// CreationRevno, if non-zero, requires the entry's creationRevno
+	// to equal it, i.e. that it's still the same incarnation of the
+	// entity the caller originally observed.
+	CreationRevno int64
+}
+
+// matches reports whether entry currently satisfies p.
+func (p Precondition) matches(entry *entityEntry) bool {
+	if p.Revno != 0 && entry.revno != p.Revno {
+		return false
+	}
+	if p.CreationRevno != 0 && entry.creationRevno != p.CreationRevno {
+		return false
+	}
+	return true
+}
+
+// infoId is the type of the keys used to look up entities in an
+// allInfo. A production backing uses entityId; tests use their own,
+// simpler, comparable id types.
+type infoId interface{}
+
+// entityId holds the information needed to address an entity's
+// document: the collection it lives in and its id within that
+// collection.
+type entityId struct {
+	collection string
+	id         interface{}
+}
+
+// entityEntry holds an entry in the linked list of entities known to
+// an allWatcher.
+type entityEntry struct {
+	// creationRevno holds the allInfo's latestRevno at the time this
+	// entry was first created.
+	creationRevno int64
+
+	// revno holds the allInfo's latestRevno at the time this entry
+	// was last changed.
+	revno int64
+
+	// refCount holds a count of the number of watchers that have
+	// been given this entry's value while it was removed, and so are
+	// still waiting to be told that it is truly gone. When refCount
+	// drops to zero for a removed entry, the entry is deleted from
+	// the allInfo entirely.
+	refCount int
+
+	// removed marks that the entity no longer exists in the backing
+	// and that this entry is being kept around only until every
+	// watcher that has seen its previous state has also been sent its
+	// removal.
+	removed bool
+
+	// info holds the actual information on the entity.
+	info params.EntityInfo
+}
+
+// knownTo reports whether a watcher sitting at revno holds a reference
+// to entry - i.e. whether it has been shown entry's creation but not
+// yet shown its removal. It's used both to release references (see
+// allWatcher.leave) and to decide which references a resumed watcher
+// must be credited with (see StateWatcher.Cursor and
+// allWatcher.newStateWatcherFromCursor).
+func (entry *entityEntry) knownTo(revno int64) bool {
+	if entry.creationRevno > revno {
+		return false
+	}
+	if entry.removed && entry.revno <= revno {
+		return false
+	}
+	return true
+}
+
+// allInfo holds a list of all entities known to an allWatcher, kept in
+// most-recently-changed-first order, together with an index from
+// entity id to its position in that list.
+type allInfo struct {
+	entities    map[infoId]*list.Element
+	list        *list.List
+	latestRevno int64
+
+	// collector, if set with SetCollector, is reported to on every
+	// add, update and delete. It defaults to discarding everything,
+	// so metrics collection is entirely opt-in.
+	collector Collector
+
+	// tombstones records the last known state of entries that have
+	// been purged from entities and list entirely, most recently
+	// purged last, so that a StateWatcher resuming from a Cursor can
+	// still be told about a removal it would otherwise have no way of
+	// seeing (see megawatchercursor.go). It's trimmed by
+	// pruneTombstones, trading the ability to resume across a very
+	// long disconnection for bounded memory use.
+	tombstones []tombstone
+
+	// tokens is a min-heap of the revno every currently-outstanding
+	// Cursor (one taken but not yet given to Resume) was taken at, so
+	// pruneTombstones knows how far back it must keep answering a
+	// resume from, rather than discarding tombstones a live Cursor
+	// might still need just because the fixed cap was reached (see
+	// megawatchercursor.go).
+	tokens tokenHeap
+}
+
+// maxTombstones bounds allInfo.tombstones whenever there's no
+// outstanding Cursor to honour: trading the ability to resume across a
+// very long disconnection for bounded memory use. It has no effect
+// while any Cursor is outstanding - see pruneTombstones.
+const maxTombstones = 1000
+
+// tombstone remembers enough about a purged entityEntry to tell a
+// resuming StateWatcher that it's gone.
+type tombstone struct {
+	// creationRevno is copied from the entry at the moment it was
+	// purged, so a resuming Cursor can tell whether it ever saw the
+	// entity. revno is the allInfo's latestRevno at that moment, so
+	// pruneTombstones can tell whether the purge happened after an
+	// outstanding Cursor was taken.
+	creationRevno int64
+	revno         int64
+
+	// info holds the entity's state as of just before it was purged,
+	// so the synthetic delta a resumed watcher is sent looks exactly
+	// like one it would have received by staying connected.
+	info params.EntityInfo
+}
+
+// recordTombstone notes that entry has been purged from a's entities
+// and list entirely, for the benefit of any StateWatcher that later
+// resumes from a Cursor taken before the purge.
+func (a *allInfo) recordTombstone(entry *entityEntry) {
+	a.tombstones = append(a.tombstones, tombstone{
+		creationRevno: entry.creationRevno,
+		revno:         a.latestRevno,
+		info:          entry.info,
+	})
+	a.pruneTombstones()
+}
+
+// pruneTombstones trims a.tombstones once it's grown past
+// maxTombstones, but only as far as the oldest outstanding Cursor
+// allows: a tombstone at or after that Cursor's revno might be exactly
+// what its eventual Resume needs to see, so it's kept regardless of
+// how far past maxTombstones the slice has grown. With no outstanding
+// Cursor at all - the common case, since most watchers either stay
+// connected or Stop outright - it falls back to the fixed cap. A Cursor
+// that is never given to Resume stays outstanding, so every tombstone
+// from its revno onward is kept for as long as the allInfo lives.
+func (a *allInfo) pruneTombstones() {
+	if len(a.tombstones) <= maxTombstones {
+		return
+	}
+	if a.tokens.Len() == 0 {
+		a.tombstones = a.tombstones[len(a.tombstones)-maxTombstones:]
+		return
+	}
+	oldest := a.tokens[0].revno
+	cut := 0
+	for cut < len(a.tombstones) && a.tombstones[cut].revno < oldest {
+		cut++
+	}
+	a.tombstones = a.tombstones[cut:]
+}
+
+// newAllInfo returns an allInfo instance holding information about the
+// current state of all entities in the environment.
+func newAllInfo() *allInfo {
+	return &allInfo{
+		entities: make(map[infoId]*list.Element),
+		list:     list.New(),
+	}
+}
+
+// metrics returns the Collector to report to, defaulting to one that
+// discards everything if SetCollector has never been called.
+func (a *allInfo) metrics() Collector {
+	if a.collector == nil {
+		return nullCollector{}
+	}
+	return a.collector
+}
+
+// reportSizeGauges pushes a's current entity and removed-entity counts
+// to its collector. It's called after every mutation that can change
+// either count, rather than
+// maintaining running counters alongside refCount bookkeeping that's
+// already fiddly enough to get right.
+func (a *allInfo) reportSizeGauges() {
+	removed := 0
+	for e := a.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(*entityEntry).removed {
+			removed++
+		}
+	}
+	a.metrics().SetEntityCount(a.list.Len())
+	a.metrics().SetRemovedEntityCount(removed)
+}
+
+// add adds a new entity with the given id and information to the
+// list.
+func (a *allInfo) add(id infoId, info params.EntityInfo) {
+	a.latestRevno++
+	entry := &entityEntry{
+		info:          info,
+		revno:         a.latestRevno,
+		creationRevno: a.latestRevno,
+	}
+	a.entities[id] = a.list.PushFront(entry)
+	a.metrics().AddRevnosIssued(1)
+	a.metrics().AddEntityChange(info.EntityKind(), "add")
+	a.reportSizeGauges()
+}
+
+// delete deletes the entry with the given id.
+func (a *allInfo) delete(id infoId) {
+	elem, ok := a.entities[id]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*entityEntry)
+	a.list.Remove(elem)
+	delete(a.entities, id)
+	a.recordTombstone(entry)
+	a.metrics().AddEntityChange(entry.info.EntityKind(), "delete")
+	a.reportSizeGauges()
+}
+
+// update updates the information for the given id, adding it to the
+// list if it didn't exist before. If info is nil, the entity is
+// marked as removed rather than being updated - it stays in the list,
+// with refCount unchanged, until every watcher that has a reference to
+// it has been told about its removal (see allInfo.seen), at which
+// point it's removed for good.
+func (a *allInfo) update(id infoId, info params.EntityInfo) {
+	elem, ok := a.entities[id]
+	if info == nil {
+		if ok {
+			a.markRemoved(id, elem)
+		}
+		return
+	}
+	if !ok {
+		a.add(id, info)
+		return
+	}
+	entry := elem.Value.(*entityEntry)
+	a.latestRevno++
+	entry.info = info
+	entry.revno = a.latestRevno
+	a.list.MoveToFront(elem)
+	a.metrics().AddRevnosIssued(1)
+	a.metrics().AddEntityChange(info.EntityKind(), "update")
+}
+
+// updateIfMatch is like update, but first checks that the entry named
+// by id - if any - satisfies pre, returning ErrPreconditionFailed and
+// leaving the allInfo untouched otherwise. It lets a caller that holds
+// the revno it last observed for an entity (e.g. from a params.Delta)
+// issue an optimistic update that fails rather than clobbers a change
+// it never saw.
+func (a *allInfo) updateIfMatch(id infoId, info params.EntityInfo, pre Precondition) error {
+	elem, ok := a.entities[id]
+	if !ok {
+		if pre.Revno != 0 || pre.CreationRevno != 0 {
+			return ErrPreconditionFailed
+		}
+	} else if !pre.matches(elem.Value.(*entityEntry)) {
+		return ErrPreconditionFailed
+	}
+	a.update(id, info)
+	return nil
+}
+
+// deleteIfMatch is like delete, but first checks that the entry named
+// by id satisfies pre, returning ErrPreconditionFailed and leaving the
+// allInfo untouched otherwise. Deleting a nonexistent entry is itself
+// a precondition failure, since there is nothing for pre to match.
+func (a *allInfo) deleteIfMatch(id infoId, pre Precondition) error {
+	elem, ok := a.entities[id]
+	if !ok || !pre.matches(elem.Value.(*entityEntry)) {
+		return ErrPreconditionFailed
+	}
+	a.delete(id)
+	return nil
+}
+
+// markRemoved marks the entry held by elem as removed. If nothing is
+// holding a reference to it, it's deleted outright instead, since no
+// watcher needs telling.
+func (a *allInfo) markRemoved(id infoId, elem *list.Element) {
+	entry := elem.Value.(*entityEntry)
+	if entry.removed {
+		return
+	}
+	a.latestRevno++
+	a.metrics().AddRevnosIssued(1)
+	if entry.refCount == 0 {
+		a.list.Remove(elem)
+		delete(a.entities, id)
+		a.recordTombstone(entry)
+		a.metrics().AddEntityChange(entry.info.EntityKind(), "delete")
+		a.reportSizeGauges()
+		return
+	}
+	entry.removed = true
+	entry.revno = a.latestRevno
+	a.list.MoveToFront(elem)
+	a.metrics().AddEntityChange(entry.info.EntityKind(), "remove")
+	a.reportSizeGauges()
+}
+
+// decRef decrements the reference count of an entry, deleting it if
+// it has been removed and the reference count reaches zero.
+func (a *allInfo) decRef(entry *entityEntry, id infoId) {
+	entry.refCount--
+	if entry.refCount > 0 || !entry.removed {
+		return
+	}
+	if elem, ok := a.entities[id]; ok {
+		a.list.Remove(elem)
+		delete(a.entities, id)
+		a.recordTombstone(entry)
+		a.metrics().AddEntityChange(entry.info.EntityKind(), "delete")
+		a.reportSizeGauges()
+	}
+}
+
+// matchedChange pairs an id with the entry it names. It's returned by
+// matchSince so that callers with access to the id - which entryDelta
+// doesn't need, but decRef does - can adjust reference counts for the
+// watcher the changes are being sent to.
+type matchedChange struct {
+	id    infoId
+	entry *entityEntry
+}
+
+// matchSince returns, in oldest-first order, every entry that has
+// changed since revno. An entity that was created and removed entirely
+// within the gap - so that a watcher sitting at revno never saw it
+// exist - is omitted, since there is nothing useful to tell such a
+// watcher.
+func (a *allInfo) matchSince(revno int64) []matchedChange {
+	var matches []matchedChange
+	for e := a.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		if entry.revno <= revno {
+			break
+		}
+		if entry.removed && entry.creationRevno > revno {
+			continue
+		}
+		id := a.idOf(e)
+		matches = append(matches, matchedChange{id: id, entry: entry})
+	}
+	// a.list holds newest-first; callers want oldest-first.
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+// idOf returns the id of the entity held in elem. It's only used by
+// matchSince's list traversal, which doesn't otherwise have easy
+// access to the id that indexes a.entities.
+func (a *allInfo) idOf(elem *list.Element) infoId {
+	for id, e := range a.entities {
+		if e == elem {
+			return id
+		}
+	}
+	panic("entity in list but not in entities index")
+}
+
+// seen records that the watcher currently at revno has now been shown
+// entry's state by this response, so that when it eventually stops (or
+// is shown the entity's removal) the right reference is released. See
+// allWatcher.leave for the corresponding release.
+func (a *allInfo) seen(id infoId, entry *entityEntry, revno int64) {
+	if entry.creationRevno > revno {
+		// First time this watcher has heard of the entity: it must
+		// be live, since matchSince omits anything created and
+		// removed in a single gap.
+		entry.refCount++
+		return
+	}
+	if entry.removed {
+		// The watcher already knew about the entity; this is the
+		// first time it's seen the removal, so release the
+		// reference taken when it first learned of the entity.
+		a.decRef(entry, id)
+	}
+}
+
+// changesSince returns any changes that have occurred since revno,
+// always encoded as full EntityInfo replacements. Only tests call it -
+// respond builds each watcher's deltas through buildResponse instead -
+// and it never adjusts reference counts, since unlike respond it isn't
+// tied to any particular watcher's lifecycle.
+func (a *allInfo) changesSince(revno int64) []params.Delta {
+	matches := a.matchSince(revno)
+	changes := make([]params.Delta, len(matches))
+	for i, m := range matches {
+		changes[i] = a.entryDelta(m.id, m.entry)
+	}
+	return changes
+}
+
+// allRequest holds a request from the StateWatcher to the allWatcher
+// for some changes. The request will be sent on the request channel,
+// and will be replied to when there are some changes to be sent.
+//
+// If the reply is false, it means that the channel has been closed
+// and no more deltas will be sent.
+type allRequest struct {
+	// w holds the StateWatcher that has originated the request.
+	w *StateWatcher
+
+	// reply receives a message when deltas are ready. If the
+	// request is replied to with false, the StateWatcher has been
+	// stopped and no further requests will be serviced.
+	reply chan bool
+
+	// On reply, changes will hold changes that have occurred since
+	// the last replied-to allRequest.
+	changes []params.Delta
+
+	// next points to the next request in the list of outstanding
+	// requests for a given watcher. It is used only by the central
+	// allWatcher goroutine.
+	next *allRequest
+
+	// attach, if non-nil, asks the allWatcher to build a new
+	// StateWatcher resuming from *attach rather than to service w. It
+	// is mutually exclusive with every other field: a request either
+	// attaches a resumed watcher, or asks about one that already
+	// exists.
+	attach *Cursor
+
+	// attached receives the StateWatcher built for attach, once it has
+	// been registered and had its reference counts charged.
+	attached chan *StateWatcher
+
+	// snapshot, if non-nil, asks the allWatcher to detach w and reply
+	// with a Cursor it can later be resumed from (see
+	// StateWatcher.Cursor in megawatchercursor.go), rather than to
+	// service w's next set of changes. Like attach, it is mutually
+	// exclusive with every other field.
+	snapshot chan Cursor
+
+	// err is set alongside a false reply to explain why: nil means the
+	// watcher was stopped normally, ErrWatcherOverflow means this
+	// request was dropped for being too far behind (see
+	// maxPendingRequests).
+	err error
+}
+
+// allWatcherBacking is the interface a source of entity changes
+// (typically, the database) must implement to drive an allWatcher.
+type allWatcherBacking interface {
+	// watch watches for any changes and sends them on the given
+	// channel.
+	watch(in chan<- watcher.Change)
+
+	// unwatch stops watch from sending any further changes.
+	unwatch(in chan<- watcher.Change)
+
+	// getAll retrieves the entire current state and places it in the
+	// given allInfo.
+	getAll(all *allInfo) error
+
+	// changed updates the allInfo to reflect the change described by
+	// the given watcher.Change.
+	changed(all *allInfo, change watcher.Change) error
+}
+
+// allWatcher holds a shared record of all entities known to all
+// StateWatchers: each watcher's view is a moving window (revno-based)
+// over the same allInfo.
+type allWatcher struct {
+	backing allWatcherBacking
+	all     *allInfo
+
+	// request receives requests from StateWatcher clients.
+	request chan *allRequest
+
+	// waiting holds, for each watcher with an outstanding request,
+	// the most recently made request. Older requests for the same
+	// watcher are threaded off the head via allRequest.next.
+	waiting map[*StateWatcher]*allRequest
+
+	// collector, if set with SetCollector, is reported to from handle
+	// and respond. It defaults to discarding everything, so metrics
+	// collection is entirely opt-in.
+	collector Collector
+
+	// respondWorkers bounds how many watchers respond builds deltas
+	// for concurrently; it defaults to runtime.NumCPU() in
+	// newAllWatcher. See SetRespondWorkers.
+	respondWorkers int
+
+	tomb tomb.Tomb
+}
+
+// newAllWatcher returns an allWatcher that watches the given backing.
+func newAllWatcher(backing allWatcherBacking) *allWatcher {
+	return &allWatcher{
+		backing:        backing,
+		all:            newAllInfo(),
+		request:        make(chan *allRequest),
+		waiting:        make(map[*StateWatcher]*allRequest),
+		respondWorkers: runtime.NumCPU(),
+	}
+}
+
+// SetRespondWorkers overrides the number of goroutines respond fans its
+// per-watcher delta assembly out across, replacing the runtime.NumCPU()
+// default newAllWatcher sets. It must be called before aw.run starts,
+// since respond reads it without locking.
+func (aw *allWatcher) SetRespondWorkers(n int) {
+	aw.respondWorkers = n
+}
+
+// workerCount returns the number of goroutines respond may run at
+// once, falling back to 1 for a non-positive respondWorkers rather than
+// let a zero-size semaphore deadlock it.
+func (aw *allWatcher) workerCount() int {
+	if aw.respondWorkers > 0 {
+		return aw.respondWorkers
+	}
+	return 1
+}
+
+// SetCollector arranges for metrics describing aw and the allInfo it
+// holds to be reported to c, replacing whatever collector (if any) aw
+// was previously reporting to.
+func (aw *allWatcher) SetCollector(c Collector) {
+	aw.collector = c
+	aw.all.collector = c
+}
+
+// metrics returns the Collector to report to, defaulting to one that
+// discards everything if SetCollector has never been called.
+func (aw *allWatcher) metrics() Collector {
+	if aw.collector == nil {
+		return nullCollector{}
+	}
+	return aw.collector
+}
+
+// Stop stops the allWatcher.
+func (aw *allWatcher) Stop() error {
+	aw.tomb.Kill(nil)
+	return aw.tomb.Wait()
+}
+
+// run is the allWatcher's main loop, and should be run in its own
+// goroutine.
+func (aw *allWatcher) run() {
+	defer aw.tomb.Done()
+	aw.tomb.Kill(aw.loop())
+}
+
+func (aw *allWatcher) loop() error {
+	in := make(chan watcher.Change)
+	aw.backing.watch(in)
+	defer aw.backing.unwatch(in)
+	if err := aw.backing.getAll(aw.all); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-aw.tomb.Dying():
+			return tomb.ErrDying
+		case change := <-in:
+			if err := aw.backing.changed(aw.all, change); err != nil {
+				return err
+			}
+		case req := <-aw.request:
+			aw.handle(req)
+		}
+		aw.respond()
+	}
+}
+
+// handle processes a request from a StateWatcher: a reply channel of
+// nil means the watcher has stopped and any further requests for it
+// should be discarded.
+func (aw *allWatcher) handle(req *allRequest) {
+	if req.attach != nil {
+		w := aw.newStateWatcherFromCursor(*req.attach)
+		aw.metrics().AddWatcherCount(1)
+		req.attached <- w
+		return
+	}
+	if req.snapshot != nil {
+		req.snapshot <- aw.cursorFor(req.w)
+		return
+	}
+	if req.reply == nil {
+		for r := aw.waiting[req.w]; r != nil; r = r.next {
+			r.reply <- false
+		}
+		delete(aw.waiting, req.w)
+		aw.metrics().SetPendingRequests(req.w, 0)
+		aw.leave(req.w)
+		req.w.stopped = true
+		aw.metrics().AddWatcherCount(-1)
+		return
+	}
+	if req.w.stopped {
+		// A stop request for this watcher was already handled; any
+		// request arriving after that - however it was interleaved
+		// with the stop on the wire - gets the same answer, rather
+		// than waiting forever for a respond() that will never
+		// service it.
+		req.reply <- false
+		return
+	}
+	if pendingRequestCount(aw.waiting[req.w])+1 > maxPendingRequests {
+		req.err = ErrWatcherOverflow
+		req.reply <- false
+		return
+	}
+	req.next = aw.waiting[req.w]
+	aw.waiting[req.w] = req
+	aw.metrics().SetPendingRequests(req.w, pendingRequestCount(req))
+}
+
+// pendingRequestCount returns the number of allRequests threaded from
+// req via next, i.e. the number of outstanding requests for whichever
+// watcher req belongs to.
+func pendingRequestCount(req *allRequest) int {
+	n := 0
+	for r := req; r != nil; r = r.next {
+		n++
+	}
+	return n
+}
+
+// releaseKnownTo releases every reference w holds - every entity it's
+// been shown but not yet been shown the removal of - calling collect
+// with each one's entry first if collect is non-nil. It's the release
+// half of the bookkeeping allInfo.seen (or, for a filtered watcher,
+// filterDelta's refTake) builds up, used both when w is stopping for
+// good (see allWatcher.leave) and when it's only disconnecting, via a
+// Cursor, to resume later (see allWatcher.cursorFor in
+// megawatchercursor.go).
+//
+// An unfiltered watcher holds a reference to every entity knownTo its
+// revno. A filtered watcher only ever took a reference on the entities
+// its filter matched - w.matched - since applyResponse advances its
+// revno regardless of match, so knownTo(w.revno) would overcount and
+// release references it never held, stealing them out from under
+// whichever other watcher still legitimately holds one.
+func (aw *allWatcher) releaseKnownTo(w *StateWatcher, collect func(entry *entityEntry)) {
+	if w.filter != nil {
+		for id := range w.matched {
+			elem, ok := aw.all.entities[id]
+			if !ok {
+				continue
+			}
+			entry := elem.Value.(*entityEntry)
+			if collect != nil {
+				collect(entry)
+			}
+			aw.all.decRef(entry, id)
+		}
+		return
+	}
+	for id, elem := range aw.all.entities {
+		entry := elem.Value.(*entityEntry)
+		if !entry.knownTo(w.revno) {
+			continue
+		}
+		if collect != nil {
+			collect(entry)
+		}
+		aw.all.decRef(entry, id)
+	}
+}
+
+// leave releases every reference w is holding - every entity it has
+// been shown but not yet been shown the removal of - because w has
+// just stopped and will never ask again.
+func (aw *allWatcher) leave(w *StateWatcher) {
+	aw.releaseKnownTo(w, nil)
+}
+
+// respondResult holds what buildResponse computed for a single waiting
+// watcher: everything respond needs applyResponse to act on, back on
+// the allWatcher's own goroutine. skip is set when there was nothing
+// worth waking the watcher's request for at all - not even to update
+// its revno - mirroring respond's old outermost continue.
+type respondResult struct {
+	w       *StateWatcher
+	req     *allRequest
+	matches []matchedChange
+
+	// refActions holds, for a filtered watcher only, filterDelta's
+	// refAction for the corresponding entry in matches - applyResponse
+	// applies it instead of calling allInfo.seen, so that a filtered
+	// watcher's refCount reflects only what its filter actually
+	// matched. It's left nil for an unfiltered watcher, which still
+	// goes through allInfo.seen for every match exactly as it always
+	// has.
+	refActions []refAction
+
+	changes []params.Delta
+	skip    bool
+}
+
+// buildResponse computes the deltas and matched entries respond owes a
+// single watcher, touching nothing but state that's safe to read
+// concurrently with every other watcher's buildResponse call: allInfo's
+// entries and lists (read-only here - seen and its refCount bookkeeping
+// happen later, in applyResponse), and w's own filter state, which no
+// other goroutine touches. It's the unit respond fans out across its
+// worker pool.
+func (aw *allWatcher) buildResponse(w *StateWatcher, req *allRequest) respondResult {
+	revno := w.revno
+	matches := aw.all.matchSince(revno)
+	if len(matches) == 0 && w.pendingTombstones == nil {
+		return respondResult{skip: true}
+	}
+	var changes []params.Delta
+	var refActions []refAction
+	if w.filter != nil {
+		refActions = make([]refAction, len(matches))
+	}
+	for i, m := range matches {
+		delta, ok, ref := w.filterDelta(aw.all, m)
+		if refActions != nil {
+			refActions[i] = ref
+		}
+		if ok {
+			delta.Revno = m.entry.revno
+			changes = append(changes, delta)
+			aw.metrics().AddDeltaBytes(deltaSize(delta))
+		}
+	}
+	if w.pendingTombstones != nil {
+		changes = append(changes, aw.all.tombstoneDeltas(w.pendingTombstones)...)
+	}
+	return respondResult{w: w, req: req, matches: matches, refActions: refActions, changes: changes}
+}
+
+// applyResponse charges r's matches against allInfo's reference counts
+// and, if there's anything to report, replies to r's request - the
+// serialized half of respond's work, since refCount bookkeeping and
+// aw.waiting itself are only ever safe to mutate from the allWatcher's
+// own goroutine.
+func (aw *allWatcher) applyResponse(r respondResult) {
+	if r.skip {
+		return
+	}
+	w, req := r.w, r.req
+	if r.refActions == nil {
+		for _, m := range r.matches {
+			aw.all.seen(m.id, m.entry, w.revno)
+		}
+	} else {
+		for i, m := range r.matches {
+			switch r.refActions[i] {
+			case refTake:
+				m.entry.refCount++
+			case refRelease:
+				aw.all.decRef(m.entry, m.id)
+			}
+		}
+	}
+	w.pendingTombstones = nil
+	w.revno = aw.all.latestRevno
+	if len(r.changes) == 0 {
+		// Nothing this watcher's filter cares about changed; leave
+		// its request outstanding rather than waking it with nothing
+		// to report.
+		return
+	}
+	req.changes = r.changes
+	if req.next == nil {
+		delete(aw.waiting, w)
+		aw.metrics().SetPendingRequests(w, 0)
+	} else {
+		aw.waiting[w] = req.next
+		aw.metrics().SetPendingRequests(w, pendingRequestCount(req.next))
+	}
+	req.reply <- true
+}
+
+// respond sends a reply to the most recent outstanding request of each
+// watcher that has seen some change since it last asked, in the delta
+// format that watcher has requested. Building those deltas - the
+// expensive part for a filtered or patch-format watcher - is fanned out
+// across up to respondWorkers goroutines at once, so one model with
+// hundreds of subscribers doesn't serialize a fast watcher behind a
+// slow one; applying the results, which touches shared refCount
+// bookkeeping, happens afterwards, back on this goroutine alone.
+func (aw *allWatcher) respond() {
+	if len(aw.waiting) == 0 {
+		return
+	}
+	results := make([]respondResult, 0, len(aw.waiting))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, aw.workerCount())
+	for w, req := range aw.waiting {
+		w, req := w, req
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := aw.buildResponse(w, req)
+			resultsMu.Lock()
+			results = append(results, r)
+			resultsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for _, r := range results {
+		aw.applyResponse(r)
+	}
+}
+
+var errWatcherStopped = fmt.Errorf("state watcher was stopped")
+
+// StateWatcher watches any changes to the state.
+type StateWatcher struct {
+	all *allWatcher
+
+	// revno holds the last revno that the StateWatcher has seen, so
+	// that allWatcher.respond knows what's new.
+	revno int64
+
+	// format holds the delta encoding this watcher wants for future
+	// changes. It defaults to FormatFull, which is the only format
+	// earlier clients understand.
+	format DeltaFormat
+
+	// stopped is set on the allWatcher's own goroutine, by handle once
+	// it has processed this watcher's stop request or by cursorFor once
+	// it has detached the watcher; it's never touched on any other
+	// goroutine, so needs no locking of its own.
+	stopped bool
+
+	// filter, if set with SetFilter, restricts the entities this
+	// watcher is shown changes for. See megawatcherfilter.go.
+	filter EntityFilter
+
+	// matched records, for a watcher with a filter set, which
+	// entities it has most recently been shown as present. It's
+	// unused (and left nil) for a watcher with no filter.
+	matched map[infoId]bool
+
+	// snapshots holds, for every entity w has been sent a delta for,
+	// the full EntityInfo it was last shown - bootstrapped by that
+	// entity's first delta to w, which is always sent in full. It's
+	// consulted only when w has asked for JSON Patch or JSON Merge
+	// Patch deltas rather than full replacements (see
+	// megawatcherdelta.go), so that a patch is always built against
+	// what w itself actually has, not merely whatever allInfo most
+	// recently wrote.
+	snapshots map[infoId]params.EntityInfo
+
+	// pendingTombstones holds, for a StateWatcher just built by
+	// newStateWatcherFromCursor, the set of creation revnos its
+	// Cursor was seen to include. Its first call to Next consults
+	// this against allInfo.tombstones to report entities purged while
+	// it was disconnected (see allInfo.tombstoneDeltas), then clears
+	// it; it's nil for any watcher not resuming from a Cursor, and for
+	// one that already has.
+	pendingTombstones map[int64]bool
+}
+
+// NewStateWatcher returns a new StateWatcher observing changes made to
+// the environment hosted by backing. If collector is given, metrics
+// describing the returned watcher and its allInfo are reported to it.
+func NewStateWatcher(backing allWatcherBacking, collector ...Collector) *StateWatcher {
+	aw := newAllWatcher(backing)
+	if len(collector) > 0 {
+		aw.SetCollector(collector[0])
+	}
+	aw.metrics().AddWatcherCount(1)
+	go aw.run()
+	return &StateWatcher{all: aw}
+}
+
+// SetDeltaFormat selects the encoding used for deltas returned by
+// future calls to Next. It only affects updates to entities w has
+// already been shown once; an entity's first appearance to w is always
+// sent in full, since there is nothing yet in w.snapshots to diff it
+// against.
+func (w *StateWatcher) SetDeltaFormat(format DeltaFormat) {
+	w.format = format
+}
+
+// Next retrieves all changes that have happened since the last time it
+// was called, blocking until there are some changes available. It
+// returns an error if the watcher has been stopped.
+func (w *StateWatcher) Next() ([]params.Delta, error) {
+	req := &allRequest{
+		w:     w,
+		reply: make(chan bool, 1),
+	}
+	select {
+	case w.all.request <- req:
+	case <-w.all.tomb.Dying():
+		return nil, w.stopError()
+	}
+	select {
+	case ok := <-req.reply:
+		if !ok {
+			if req.err != nil {
+				return nil, req.err
+			}
+			return nil, errWatcherStopped
+		}
+		return req.changes, nil
+	case <-w.all.tomb.Dying():
+		return nil, w.stopError()
+	}
+}
+
+func (w *StateWatcher) stopError() error {
+	if err := w.all.tomb.Err(); err != nil {
+		return err
+	}
+	return errWatcherStopped
+}
+
+// Stop stops the watcher.
+func (w *StateWatcher) Stop() error {
+	select {
+	case w.all.request <- &allRequest{w: w}:
+	case <-w.all.tomb.Dying():
+	}
+	return nil
+}
+
+// newAllWatcherStateBacking returns an allWatcherBacking that watches
+// the collections of interest directly (machines, units, services,
+// relations and annotations), rather than loading the domain objects
+// built on top of them, so that allWatcher.loop's getAll doesn't pay
+// for more than the handful of fields each EntityInfo actually needs.
+func newAllWatcherStateBacking(st *State) *allWatcherStateBacking {
+	return &allWatcherStateBacking{st: st}
+}
+
+type allWatcherStateBacking struct {
+	st *State
+}
+
+// idForInfo returns the infoId used to index info within an allInfo:
+// the name of the collection it's stored in, plus its id within that
+// collection.
+func (b *allWatcherStateBacking) idForInfo(info params.EntityInfo) infoId {
+	return entityId{
+		collection: b.collectionNameFor(info),
+		id:         info.EntityId(),
+	}
+}
+
+func (b *allWatcherStateBacking) collectionNameFor(info params.EntityInfo) string {
+	switch info.(type) {
+	case *params.MachineInfo:
+		return b.st.machines.Name
+	case *params.UnitInfo:
+		return b.st.units.Name
+	case *params.ServiceInfo:
+		return b.st.services.Name
+	case *params.RelationInfo:
+		return b.st.relations.Name
+	case *params.AnnotationInfo:
+		return b.st.annotations.Name
+	default:
+		panic(fmt.Errorf("unknown entity type %T", info))
+	}
+}
+
+// getAll fetches the current state of every watched collection into
+// all.
+func (b *allWatcherStateBacking) getAll(all *allInfo) error {
+	for _, fetch := range b.collectionFetchers() {
+		infos, err := fetch()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			all.update(b.idForInfo(info), info)
+		}
+	}
+	return nil
+}
+
+// changed updates all to reflect a single change reported by the
+// backing's watcher.
+func (b *allWatcherStateBacking) changed(all *allInfo, change watcher.Change) error {
+	id := entityId{collection: change.C, id: change.Id}
+	info, err := b.fetch(id)
+	if err == errEntityNotFound {
+		all.update(id, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	all.update(id, info)
+	return nil
+}
+
+// updateIfMatch applies an optimistic update to the named entity,
+// failing with ErrPreconditionFailed instead of overwriting it if pre
+// no longer holds. API methods that mutate an entity on behalf of a
+// client holding a StateWatcher-observed revno should route the
+// corresponding allInfo update through here rather than through
+// changed, so a client racing another writer is told about the
+// conflict instead of silently losing it.
+func (b *allWatcherStateBacking) updateIfMatch(all *allInfo, id infoId, info params.EntityInfo, pre Precondition) error {
+	return all.updateIfMatch(id, info, pre)
+}
+
+// watch starts watching every collection that can produce an
+// EntityInfo, sending every change on in.
+func (b *allWatcherStateBacking) watch(in chan<- watcher.Change) {
+	for _, name := range b.collectionNames() {
+		b.st.watcher.WatchCollection(name, in)
+	}
+}
+
+// unwatch reverses watch.
+func (b *allWatcherStateBacking) unwatch(in chan<- watcher.Change) {
+	for _, name := range b.collectionNames() {
+		b.st.watcher.UnwatchCollection(name, in)
+	}
+}
+
+// errEntityNotFound is returned by fetch when the requested id no
+// longer has a document in its collection.
+var errEntityNotFound = fmt.Errorf("entity not found")
+
+// collectionNames returns the name of every collection whose changes
+// should be reflected in an allInfo.
+func (b *allWatcherStateBacking) collectionNames() []string {
+	return []string{
+		b.st.machines.Name,
+		b.st.units.Name,
+		b.st.services.Name,
+		b.st.relations.Name,
+		b.st.annotations.Name,
+	}
+}
+
+// collectionFetchers returns, for each watched collection, a function
+// that loads every document it currently holds as an EntityInfo.
+func (b *allWatcherStateBacking) collectionFetchers() []func() ([]params.EntityInfo, error) {
+	return []func() ([]params.EntityInfo, error){
+		b.allMachines,
+		b.allUnits,
+		b.allServices,
+		b.allRelations,
+		b.allAnnotations,
+	}
+}
+
+// fetch loads the single document named by id as an EntityInfo,
+// returning errEntityNotFound if it's gone.
+func (b *allWatcherStateBacking) fetch(id infoId) (params.EntityInfo, error) {
+	eid, ok := id.(entityId)
+	if !ok {
+		return nil, fmt.Errorf("unexpected id type %T", id)
+	}
+	switch eid.collection {
+	case b.st.machines.Name:
+		return b.fetchMachine(eid.id)
+	case b.st.units.Name:
+		return b.fetchUnit(eid.id)
+	case b.st.services.Name:
+		return b.fetchService(eid.id)
+	case b.st.relations.Name:
+		return b.fetchRelation(eid.id)
+	case b.st.annotations.Name:
+		return b.fetchAnnotation(eid.id)
+	default:
+		return nil, fmt.Errorf("unknown collection %q", eid.collection)
+	}
+}
+
+// The fetch* and all* methods below read straight from the raw
+// collection documents (as bson.M, rather than through the machineDoc
+// / unitDoc / ... types and their owning domain objects) since all an
+// EntityInfo ever needs is a handful of fields, and every allWatcher
+// client pays for getAll's cost at startup.
+
+func (b *allWatcherStateBacking) allMachines() ([]params.EntityInfo, error) {
+	var docs []bson.M
+	if err := b.st.machines.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+	infos := make([]params.EntityInfo, len(docs))
+	for i, doc := range docs {
+		infos[i] = machineInfoFromDoc(doc)
+	}
+	return infos, nil
+}
+
+func (b *allWatcherStateBacking) fetchMachine(id interface{}) (params.EntityInfo, error) {
+	var doc bson.M
+	if err := b.st.machines.FindId(id).One(&doc); err == mgo.ErrNotFound {
+		return nil, errEntityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return machineInfoFromDoc(doc), nil
+}
+
+func machineInfoFromDoc(doc bson.M) *params.MachineInfo {
+	info := &params.MachineInfo{Id: fmt.Sprint(doc["_id"])}
+	if instanceId, ok := doc["instanceid"]; ok {
+		info.InstanceId = fmt.Sprint(instanceId)
+	}
+	return info
+}
+
+func (b *allWatcherStateBacking) allUnits() ([]params.EntityInfo, error) {
+	var docs []bson.M
+	if err := b.st.units.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+	infos := make([]params.EntityInfo, len(docs))
+	for i, doc := range docs {
+		infos[i] = unitInfoFromDoc(doc)
+	}
+	return infos, nil
+}
+
+func (b *allWatcherStateBacking) fetchUnit(id interface{}) (params.EntityInfo, error) {
+	var doc bson.M
+	if err := b.st.units.FindId(id).One(&doc); err == mgo.ErrNotFound {
+		return nil, errEntityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return unitInfoFromDoc(doc), nil
+}
+
+func unitInfoFromDoc(doc bson.M) *params.UnitInfo {
+	return &params.UnitInfo{
+		Name:      fmt.Sprint(doc["_id"]),
+		Service:   fmt.Sprint(doc["service"]),
+		Series:    fmt.Sprint(doc["series"]),
+		MachineId: fmt.Sprint(doc["machineid"]),
+	}
+}
+
+func (b *allWatcherStateBacking) allServices() ([]params.EntityInfo, error) {
+	var docs []bson.M
+	if err := b.st.services.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+	infos := make([]params.EntityInfo, len(docs))
+	for i, doc := range docs {
+		infos[i] = serviceInfoFromDoc(doc)
+	}
+	return infos, nil
+}
+
+func (b *allWatcherStateBacking) fetchService(id interface{}) (params.EntityInfo, error) {
+	var doc bson.M
+	if err := b.st.services.FindId(id).One(&doc); err == mgo.ErrNotFound {
+		return nil, errEntityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return serviceInfoFromDoc(doc), nil
+}
+
+func serviceInfoFromDoc(doc bson.M) *params.ServiceInfo {
+	info := &params.ServiceInfo{Name: fmt.Sprint(doc["_id"])}
+	if exposed, ok := doc["exposed"].(bool); ok {
+		info.Exposed = exposed
+	}
+	if charmURL, ok := doc["charmurl"]; ok {
+		info.CharmURL = fmt.Sprint(charmURL)
+	}
+	return info
+}
+
+func (b *allWatcherStateBacking) allRelations() ([]params.EntityInfo, error) {
+	var docs []bson.M
+	if err := b.st.relations.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+	infos := make([]params.EntityInfo, len(docs))
+	for i, doc := range docs {
+		infos[i] = &params.RelationInfo{Key: fmt.Sprint(doc["_id"])}
+	}
+	return infos, nil
+}
+
+func (b *allWatcherStateBacking) fetchRelation(id interface{}) (params.EntityInfo, error) {
+	var doc bson.M
+	if err := b.st.relations.FindId(id).One(&doc); err == mgo.ErrNotFound {
+		return nil, errEntityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &params.RelationInfo{Key: fmt.Sprint(doc["_id"])}, nil
+}
+
+func (b *allWatcherStateBacking) allAnnotations() ([]params.EntityInfo, error) {
+	var docs []bson.M
+	if err := b.st.annotations.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+	infos := make([]params.EntityInfo, len(docs))
+	for i, doc := range docs {
+		infos[i] = annotationInfoFromDoc(doc)
+	}
+	return infos, nil
+}
+
+func (b *allWatcherStateBacking) fetchAnnotation(id interface{}) (params.EntityInfo, error) {
+	var doc bson.M
+	if err := b.st.annotations.FindId(id).One(&doc); err == mgo.ErrNotFound {
+		return nil, errEntityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return annotationInfoFromDoc(doc), nil
+}
+
+func annotationInfoFromDoc(doc bson.M) *params.AnnotationInfo {
+	info := &params.AnnotationInfo{GlobalKey: fmt.Sprint(doc["_id"])}
+	if tag, ok := doc["tag"]; ok {
+		info.Tag = fmt.Sprint(tag)
+	}
+	if annotations, ok := doc["annotations"].(map[string]interface{}); ok {
+		info.Annotations = make(map[string]string, len(annotations))
+		for k, v := range annotations {
+			info.Annotations[k] = fmt.Sprint(v)
+		}
+	}
+	return info
+}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"container/list"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"labix.org/v2/mgo"
@@ -186,6 +187,67 @@ var allInfoChangeMethodTests = []struct {
 		all.decRef(entry, id)
 	},
 	expectRevno: 2,
+}, {
+	about: "updateIfMatch succeeds when the revno precondition holds",
+	change: func(all *allInfo) {
+		m := &params.MachineInfo{Id: "0"}
+		allInfoAdd(all, m)
+		id := idForInfo(m)
+		rev := all.entities[id].Value.(*entityEntry).revno
+		err := all.updateIfMatch(id, &params.MachineInfo{
+			Id:         "0",
+			InstanceId: "i-0",
+		}, Precondition{Revno: rev})
+		if err != nil {
+			panic(err)
+		}
+	},
+	expectRevno: 2,
+	expectContents: []entityEntry{{
+		creationRevno: 1,
+		revno:         2,
+		info: &params.MachineInfo{
+			Id:         "0",
+			InstanceId: "i-0",
+		},
+	}},
+}, {
+	about: "updateIfMatch leaves the entry untouched when the revno precondition fails",
+	change: func(all *allInfo) {
+		m := &params.MachineInfo{Id: "0"}
+		allInfoAdd(all, m)
+		id := idForInfo(m)
+		err := all.updateIfMatch(id, &params.MachineInfo{
+			Id:         "0",
+			InstanceId: "i-0",
+		}, Precondition{Revno: 99})
+		if err != ErrPreconditionFailed {
+			panic(fmt.Errorf("got %v, want ErrPreconditionFailed", err))
+		}
+	},
+	expectRevno: 1,
+	expectContents: []entityEntry{{
+		creationRevno: 1,
+		revno:         1,
+		info:          &params.MachineInfo{Id: "0"},
+	}},
+}, {
+	about: "deleteIfMatch leaves the entry untouched when the creationRevno precondition fails",
+	change: func(all *allInfo) {
+		m := &params.MachineInfo{Id: "0"}
+		allInfoAdd(all, m)
+		id := idForInfo(m)
+		err := all.deleteIfMatch(id, Precondition{CreationRevno: 99})
+		if err != ErrPreconditionFailed {
+			panic(fmt.Errorf("got %v, want ErrPreconditionFailed", err))
+		}
+	},
+	expectRevno: 1,
+	expectContents: []entityEntry{{
+		creationRevno: 1,
+		revno:         1,
+		info:          &params.MachineInfo{Id: "0"},
+	}},
 },
 }
 
@@ -257,6 +319,71 @@ func (s *allInfoSuite) TestChangesSince(c *C) {
 
 }
 
+// TestUpdateIfMatchRacingWriters shows the scenario updateIfMatch
+// exists for: two writers both read the same entity off a
+// StateWatcher, observing the same revno, then race to update it. In
+// production their updates reach a single allInfo serialized through
+// the allWatcher goroutine (see allWatcher.loop), so the race reduces
+// to the two calls below happening in some order; whichever arrives
+// second finds the revno has moved on and gets ErrPreconditionFailed
+// instead of silently overwriting the winner's write.
+func (s *allInfoSuite) TestUpdateIfMatchRacingWriters(c *C) {
+	a := newAllInfo()
+	m := &params.MachineInfo{Id: "0", InstanceId: "i-0"}
+	allInfoAdd(a, m)
+	id := idForInfo(m)
+	seenRevno := a.entities[id].Value.(*entityEntry).revno
+
+	err := a.updateIfMatch(id, &params.MachineInfo{
+		Id:         "0",
+		InstanceId: "i-winner",
+	}, Precondition{Revno: seenRevno})
+	c.Assert(err, IsNil)
+
+	err = a.updateIfMatch(id, &params.MachineInfo{
+		Id:         "0",
+		InstanceId: "i-loser",
+	}, Precondition{Revno: seenRevno})
+	c.Assert(err, Equals, ErrPreconditionFailed)
+
+	entry := a.entities[id].Value.(*entityEntry)
+	c.Assert(entry.info.(*params.MachineInfo).InstanceId, Equals, "i-winner")
+}
+
+// TestPruneTombstonesRespectsOutstandingToken drives a's tombstones well
+// past maxTombstones with no outstanding token, confirming the fixed cap
+// applies as usual, then takes a token pinned partway through the
+// surviving tombstones and grows the slice past the cap again: nothing
+// at or after the pinned revno may be discarded this time. Once the
+// token is released, the fixed cap takes over again on the very next
+// purge.
+func (s *allInfoSuite) TestPruneTombstonesRespectsOutstandingToken(c *C) {
+	a := newAllInfo()
+	purge := func(id string) {
+		m := &params.MachineInfo{Id: id}
+		allInfoAdd(a, m)
+		a.delete(idForInfo(m))
+	}
+	for i := 0; i < maxTombstones+10; i++ {
+		purge(fmt.Sprint(i))
+	}
+	c.Assert(a.tombstones, HasLen, maxTombstones)
+
+	pinned := a.tombstones[5].revno
+	tok := a.trackToken(pinned)
+	for i := maxTombstones + 10; i < maxTombstones+20; i++ {
+		purge(fmt.Sprint(i))
+	}
+	c.Assert(len(a.tombstones) > maxTombstones, Equals, true)
+	for _, t := range a.tombstones {
+		c.Assert(t.revno >= pinned, Equals, true)
+	}
+
+	a.untrackToken(tok)
+	purge("final")
+	c.Assert(a.tombstones, HasLen, maxTombstones)
+}
+
 type allWatcherSuite struct {
 	testing.LoggingSuite
 }
@@ -321,6 +448,34 @@ func (*allWatcherSuite) TestHandle(c *C) {
 	assertReplied(c, false, req2)
 }
 
+// TestHandleOverflow chains maxPendingRequests requests for a single
+// watcher, then checks that handle drops the next one with
+// ErrWatcherOverflow rather than growing the chain further, leaving
+// the watcher's existing backlog untouched.
+func (*allWatcherSuite) TestHandleOverflow(c *C) {
+	aw := newAllWatcher(newTestBacking(nil))
+	w := &StateWatcher{all: aw}
+
+	var reqs []*allRequest
+	for i := 0; i < maxPendingRequests; i++ {
+		req := &allRequest{w: w, reply: make(chan bool, 1)}
+		aw.handle(req)
+		reqs = append(reqs, req)
+	}
+	c.Assert(pendingRequestCount(aw.waiting[w]), Equals, maxPendingRequests)
+
+	overflow := &allRequest{w: w, reply: make(chan bool, 1)}
+	aw.handle(overflow)
+	c.Assert(pendingRequestCount(aw.waiting[w]), Equals, maxPendingRequests)
+	select {
+	case ok := <-overflow.reply:
+		c.Assert(ok, Equals, false)
+		c.Assert(overflow.err, Equals, ErrWatcherOverflow)
+	default:
+		c.Fatalf("overflowing request was not replied to")
+	}
+}
+
 func (s *allWatcherSuite) TestHandleStopNoDecRefIfMoreRecentlyCreated(c *C) {
 	// If the StateWatcher hasn't seen the item, then we shouldn't
 	// decrement its ref count when it is stopped.
@@ -525,6 +680,499 @@ func (s *allWatcherSuite) TestRespondResults(c *C) {
 	}
 }
 
+// testCollector is a Collector that records the values it's given, for
+// tests to inspect directly rather than scraping an http.Handler.
+type testCollector struct {
+	mu sync.Mutex
+
+	watcherCount       int
+	pendingRequests    map[*StateWatcher]int
+	entityCount        int
+	removedEntityCount int
+	revnosIssued       int64
+	deltaBytes         int
+	entityChanges      map[entityChangeKey]int64
+}
+
+func newTestCollector() *testCollector {
+	return &testCollector{
+		pendingRequests: make(map[*StateWatcher]int),
+		entityChanges:   make(map[entityChangeKey]int64),
+	}
+}
+
+func (tc *testCollector) AddWatcherCount(delta int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.watcherCount += delta
+}
+
+func (tc *testCollector) SetPendingRequests(w *StateWatcher, n int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if n == 0 {
+		delete(tc.pendingRequests, w)
+		return
+	}
+	tc.pendingRequests[w] = n
+}
+
+func (tc *testCollector) SetEntityCount(n int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entityCount = n
+}
+
+func (tc *testCollector) SetRemovedEntityCount(n int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.removedEntityCount = n
+}
+
+func (tc *testCollector) AddRevnosIssued(n int64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.revnosIssued += n
+}
+
+func (tc *testCollector) AddDeltaBytes(n int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.deltaBytes += n
+}
+
+func (tc *testCollector) AddEntityChange(kind, op string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entityChanges[entityChangeKey{kind, op}]++
+}
+
+// TestCollectorSeesRespondTestChanges drives respondTestChanges - the
+// same change sequence TestRespondResults exercises - through an
+// allWatcher with a collector attached, then a single respond, and
+// checks the resulting metric values match what that sequence is
+// known to do. No watcher has been shown any of the three machines
+// when they're removed, so both removals happen with a zero refCount
+// and delete the entry outright rather than retaining it: only
+// machine "2" (never removed) survives, matching respondTestFinalState.
+func (s *allWatcherSuite) TestCollectorSeesRespondTestChanges(c *C) {
+	tc := newTestCollector()
+	aw := newAllWatcher(&allWatcherTestBacking{})
+	aw.SetCollector(tc)
+
+	w := &StateWatcher{all: aw}
+	// This test drives aw.handle/aw.respond directly rather than going
+	// through NewStateWatcher, so it must credit w's AddWatcherCount(1)
+	// itself, exactly as NewStateWatcher would have.
+	tc.AddWatcherCount(1)
+	req := &allRequest{w: w, reply: make(chan bool, 1)}
+	aw.handle(req)
+	c.Assert(tc.pendingRequests[w], Equals, 1)
+
+	for _, change := range respondTestChanges {
+		change(aw.all)
+	}
+	c.Assert(tc.revnosIssued, Equals, respondTestFinalRevno)
+	c.Assert(tc.entityChanges[entityChangeKey{"machine", "add"}], Equals, int64(3))
+	c.Assert(tc.entityChanges[entityChangeKey{"machine", "update"}], Equals, int64(1))
+	c.Assert(tc.entityChanges[entityChangeKey{"machine", "delete"}], Equals, int64(2))
+	c.Assert(tc.entityChanges[entityChangeKey{"machine", "remove"}], Equals, int64(0))
+	s.assertAllInfoContents(c, aw.all, respondTestFinalRevno, respondTestFinalState)
+	c.Assert(tc.entityCount, Equals, len(respondTestFinalState))
+	c.Assert(tc.removedEntityCount, Equals, 0)
+
+	aw.respond()
+	select {
+	case ok := <-req.reply:
+		c.Assert(ok, Equals, true)
+	default:
+		c.Fatalf("request was never replied to")
+	}
+	c.Assert(tc.pendingRequests[w], Equals, 0)
+	c.Assert(tc.deltaBytes > 0, Equals, true)
+
+	aw.handle(&allRequest{w: w})
+	c.Assert(tc.watcherCount, Equals, 0)
+	c.Assert(tc.entityCount, Equals, len(respondTestFinalState))
+	c.Assert(tc.removedEntityCount, Equals, 0)
+}
+
+// TestRespondFiltered is analogous to TestRespondResults, but drives
+// one unfiltered and one filtered watcher through the same sequence of
+// changes and checks each sees only what its own filter allows -
+// including a synthetic removal when an entity it was previously shown
+// stops matching, even though the entity itself is still alive.
+func (s *allWatcherSuite) TestRespondFiltered(c *C) {
+	aw := newAllWatcher(&allWatcherTestBacking{})
+
+	wAll := &StateWatcher{all: aw}
+	wM0 := &StateWatcher{all: aw}
+	wM0.SetFilter(FilterByMachineId("0"))
+
+	reqAll := &allRequest{w: wAll, reply: make(chan bool, 1)}
+	reqM0 := &allRequest{w: wM0, reply: make(chan bool, 1)}
+	aw.handle(reqAll)
+	aw.handle(reqM0)
+
+	checkReply := func(req *allRequest, want []params.Delta) {
+		select {
+		case ok := <-req.reply:
+			c.Assert(ok, Equals, true)
+			checkDeltasEqual(c, req.changes, want)
+		default:
+			c.Fatalf("request was never replied to")
+		}
+	}
+
+	// Add machine "0" and a unit assigned to it, plus an unrelated
+	// machine "1". wAll sees all three. wM0's filter matches machine
+	// "0" directly and the unit via its MachineId, and never matches
+	// machine "1", so wM0 should never hear about it at all.
+	unit0 := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "0"}
+	allInfoAdd(aw.all, &params.MachineInfo{Id: "0"})
+	allInfoAdd(aw.all, &params.MachineInfo{Id: "1"})
+	allInfoAdd(aw.all, unit0)
+	aw.respond()
+
+	checkReply(reqAll, []params.Delta{
+		{Entity: &params.MachineInfo{Id: "0"}},
+		{Entity: &params.MachineInfo{Id: "1"}},
+		{Entity: unit0},
+	})
+	checkReply(reqM0, []params.Delta{
+		{Entity: &params.MachineInfo{Id: "0"}},
+		{Entity: unit0},
+	})
+
+	// Reassign the unit to machine "1": wAll just sees a normal
+	// update, but wM0's filter no longer matches it, so wM0 is told
+	// it's gone, exactly as if it had been removed outright.
+	reqAll = &allRequest{w: wAll, reply: make(chan bool, 1)}
+	reqM0 = &allRequest{w: wM0, reply: make(chan bool, 1)}
+	aw.handle(reqAll)
+	aw.handle(reqM0)
+
+	unit0Moved := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "1"}
+	aw.all.update(idForInfo(unit0), unit0Moved)
+	aw.respond()
+
+	checkReply(reqAll, []params.Delta{
+		{Entity: unit0Moved},
+	})
+	checkReply(reqM0, []params.Delta{
+		{Removed: true, Entity: unit0Moved},
+	})
+
+	// Remove machine "1" outright: wAll sees the real removal; wM0
+	// never matched it, so it hears nothing at all and its request
+	// stays outstanding.
+	reqAll = &allRequest{w: wAll, reply: make(chan bool, 1)}
+	reqM0 = &allRequest{w: wM0, reply: make(chan bool, 1)}
+	aw.handle(reqAll)
+	aw.handle(reqM0)
+
+	aw.all.update(testEntityId{"machine", "1"}, nil)
+	aw.respond()
+
+	checkReply(reqAll, []params.Delta{
+		{Removed: true, Entity: &params.MachineInfo{Id: "1"}},
+	})
+	assertWaitingRequests(c, aw, map[*StateWatcher][]*allRequest{
+		wM0: {reqM0},
+	})
+}
+
+// TestRespondFilteredReleasesRefWhenFilterStopsMatching drives a unit
+// out of a filtered watcher's view, then removes it outright, and
+// checks it's purged immediately rather than staying pinned until the
+// watcher eventually disconnects: once no filter matches it any more,
+// nothing is left holding a reference by the time it's actually
+// removed.
+func (s *allWatcherSuite) TestRespondFilteredReleasesRefWhenFilterStopsMatching(c *C) {
+	aw := newAllWatcher(&allWatcherTestBacking{})
+
+	w := &StateWatcher{all: aw}
+	w.SetFilter(FilterByMachineId("0"))
+
+	req := &allRequest{w: w, reply: make(chan bool, 1)}
+	aw.handle(req)
+
+	unit0 := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "0"}
+	allInfoAdd(aw.all, unit0)
+	aw.respond()
+
+	id := idForInfo(unit0)
+	select {
+	case ok := <-req.reply:
+		c.Assert(ok, Equals, true)
+		checkDeltasEqual(c, req.changes, []params.Delta{{Entity: unit0}})
+	default:
+		c.Fatalf("request was never replied to")
+	}
+	c.Assert(aw.all.entities[id].Value.(*entityEntry).refCount, Equals, 1)
+
+	// unit0 moves off machine "0": w's filter stops matching it, so it
+	// must release the reference it took above even though w itself
+	// stays connected.
+	req = &allRequest{w: w, reply: make(chan bool, 1)}
+	aw.handle(req)
+	unit0Moved := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "1"}
+	aw.all.update(id, unit0Moved)
+	aw.respond()
+
+	select {
+	case ok := <-req.reply:
+		c.Assert(ok, Equals, true)
+		checkDeltasEqual(c, req.changes, []params.Delta{{Removed: true, Entity: unit0Moved}})
+	default:
+		c.Fatalf("request was never replied to")
+	}
+	c.Assert(aw.all.entities[id].Value.(*entityEntry).refCount, Equals, 0)
+
+	// Removing it outright now finds no outstanding reference at all,
+	// so it's purged the moment the removal lands, before respond even
+	// runs - w never hears about this removal, since it already
+	// stopped caring.
+	req = &allRequest{w: w, reply: make(chan bool, 1)}
+	aw.handle(req)
+	aw.all.update(id, nil)
+	_, stillThere := aw.all.entities[id]
+	c.Assert(stillThere, Equals, false)
+
+	aw.respond()
+	assertNotReplied(c, req)
+}
+
+// TestLeaveFilteredReleasesOnlyMatchedRefs checks that stopping a
+// filtered watcher releases only the references its filter actually
+// took (unit0, on machine "0"), not every entity knownTo its revno -
+// in particular, not unit1, which an unfiltered watcher sharing the
+// same allWatcher still legitimately holds a reference to. Before
+// releaseKnownTo learned about filters, stopping wFiltered here would
+// have stolen wOther's reference to unit1 out from under it.
+func (s *allWatcherSuite) TestLeaveFilteredReleasesOnlyMatchedRefs(c *C) {
+	aw := newAllWatcher(&allWatcherTestBacking{})
+
+	wOther := &StateWatcher{all: aw}
+	reqOther := &allRequest{w: wOther, reply: make(chan bool, 1)}
+	aw.handle(reqOther)
+
+	wFiltered := &StateWatcher{all: aw}
+	wFiltered.SetFilter(FilterByMachineId("0"))
+	reqFiltered := &allRequest{w: wFiltered, reply: make(chan bool, 1)}
+	aw.handle(reqFiltered)
+
+	unit0 := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "0"}
+	unit1 := &params.UnitInfo{Name: "wordpress/1", Service: "wordpress", MachineId: "1"}
+	allInfoAdd(aw.all, unit0)
+	allInfoAdd(aw.all, unit1)
+	aw.respond()
+
+	<-reqOther.reply
+	<-reqFiltered.reply
+
+	id0 := idForInfo(unit0)
+	id1 := idForInfo(unit1)
+	c.Assert(aw.all.entities[id0].Value.(*entityEntry).refCount, Equals, 2)
+	c.Assert(aw.all.entities[id1].Value.(*entityEntry).refCount, Equals, 1)
+
+	// Stop wFiltered. It only ever matched unit0, so only unit0's
+	// refCount should drop.
+	aw.handle(&allRequest{w: wFiltered})
+
+	c.Assert(aw.all.entities[id0].Value.(*entityEntry).refCount, Equals, 1)
+	c.Assert(aw.all.entities[id1].Value.(*entityEntry).refCount, Equals, 1)
+
+	// wOther's reference to unit1 must still be intact: removing it
+	// now is reported, not silently purged.
+	aw.all.update(id1, nil)
+	_, stillThere := aw.all.entities[id1]
+	c.Assert(stillThere, Equals, true)
+
+	reqOther = &allRequest{w: wOther, reply: make(chan bool, 1)}
+	aw.handle(reqOther)
+	aw.respond()
+	select {
+	case ok := <-reqOther.reply:
+		c.Assert(ok, Equals, true)
+		checkDeltasEqual(c, reqOther.changes, []params.Delta{{Removed: true, Entity: unit1}})
+	default:
+		c.Fatalf("request was never replied to")
+	}
+}
+
+// TestDeltaFormatPatchRoundTripsFullStream drives two updates to the
+// same entity - each touching a different field - through a single
+// respond() call, so that matchSince coalesces them into one current
+// state the way it always does, and checks that a client applying the
+// resulting JSON Merge Patch delta to its own last-held copy ends up
+// bit-identical to what a FormatFull watcher was sent for the same
+// span. A shared allInfo-wide "state just before the last write" base
+// would diff against the intermediate state instead of what this
+// watcher actually has, silently dropping whichever field changed
+// first.
+func (s *allWatcherSuite) TestDeltaFormatPatchRoundTripsFullStream(c *C) {
+	aw := newAllWatcher(&allWatcherTestBacking{})
+
+	wFull := &StateWatcher{all: aw}
+	wPatch := &StateWatcher{all: aw}
+	wPatch.SetDeltaFormat(FormatJSONMerge)
+
+	reqFull := &allRequest{w: wFull, reply: make(chan bool, 1)}
+	reqPatch := &allRequest{w: wPatch, reply: make(chan bool, 1)}
+	aw.handle(reqFull)
+	aw.handle(reqPatch)
+
+	unit0 := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", Series: "trusty", MachineId: "0"}
+	allInfoAdd(aw.all, unit0)
+	aw.respond()
+
+	checkReply := func(req *allRequest, want []params.Delta) {
+		select {
+		case ok := <-req.reply:
+			c.Assert(ok, Equals, true)
+			checkDeltasEqual(c, req.changes, want)
+		default:
+			c.Fatalf("request was never replied to")
+		}
+	}
+	checkReply(reqFull, []params.Delta{{Entity: unit0}})
+	checkReply(reqPatch, []params.Delta{{Entity: unit0}})
+
+	// clientFields is what wPatch's own client now holds, having
+	// applied that initial full delta - the base later merge patches
+	// must diff against.
+	clientFields, err := entityFields(unit0)
+	c.Assert(err, IsNil)
+
+	reqFull = &allRequest{w: wFull, reply: make(chan bool, 1)}
+	reqPatch = &allRequest{w: wPatch, reply: make(chan bool, 1)}
+	aw.handle(reqFull)
+	aw.handle(reqPatch)
+
+	unit0Moved := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", Series: "trusty", MachineId: "1"}
+	aw.all.update(idForInfo(unit0), unit0Moved)
+	unit0Upgraded := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", Series: "xenial", MachineId: "1"}
+	aw.all.update(idForInfo(unit0), unit0Upgraded)
+	aw.respond()
+
+	checkReply(reqFull, []params.Delta{{Entity: unit0Upgraded}})
+
+	select {
+	case ok := <-reqPatch.reply:
+		c.Assert(ok, Equals, true)
+		c.Assert(reqPatch.changes, HasLen, 1)
+	default:
+		c.Fatalf("request was never replied to")
+	}
+	patch, ok := reqPatch.changes[0].Entity.(*JSONPatchInfo)
+	c.Assert(ok, Equals, true)
+	c.Assert(patch.Merge, Equals, true)
+	clientFields = applyMergePatch(c, clientFields, patch.Patch)
+
+	wantFields, err := entityFields(unit0Upgraded)
+	c.Assert(err, IsNil)
+	c.Assert(clientFields, DeepEquals, wantFields)
+}
+
+// applyMergePatch simulates a client applying an RFC 7396 JSON Merge
+// Patch document to its own locally-held fields: a field set to null
+// is removed, every other field in patch overwrites prev's, and
+// anything patch doesn't mention is left alone.
+func applyMergePatch(c *C, prev map[string]json.RawMessage, patch json.RawMessage) map[string]json.RawMessage {
+	var ops map[string]json.RawMessage
+	c.Assert(json.Unmarshal(patch, &ops), IsNil)
+	next := make(map[string]json.RawMessage, len(prev))
+	for field, value := range prev {
+		next[field] = value
+	}
+	for field, value := range ops {
+		if string(value) == "null" {
+			delete(next, field)
+			continue
+		}
+		next[field] = value
+	}
+	return next
+}
+
+// TestFilteredWatcherFirstMatchIsFull drives an update to an entity
+// while a patch-format watcher's filter doesn't yet match it, then
+// changes the filter to match and checks the watcher's first delta for
+// that entity is a full send: w.snapshots holds nothing for an id it
+// has never matched before, however allInfo itself has moved on, so
+// entryDelta's usual fallback already does the right thing.
+func (*allWatcherSuite) TestFilteredWatcherFirstMatchIsFull(c *C) {
+	aw := newAllWatcher(&allWatcherTestBacking{})
+
+	w := &StateWatcher{all: aw}
+	w.SetDeltaFormat(FormatJSONMerge)
+	w.SetFilter(FilterByService("mysql"))
+
+	unit0 := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress"}
+	allInfoAdd(aw.all, unit0)
+	req := &allRequest{w: w, reply: make(chan bool, 1)}
+	aw.handle(req)
+	aw.respond()
+
+	// unit0 doesn't match w's filter, so w is left waiting rather than
+	// replied to - exactly as TestRespondFiltered's own unmatched case.
+	assertWaitingRequests(c, aw, map[*StateWatcher][]*allRequest{
+		w: {req},
+	})
+
+	// Still invisible to w's filter, but this moves the entity's actual
+	// state forward - w must not be asked to patch against it once it
+	// starts watching it, since it was never shown this update.
+	unit0Updated := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "0"}
+	aw.all.update(idForInfo(unit0), unit0Updated)
+
+	w.SetFilter(FilterByService("wordpress"))
+	aw.respond()
+	select {
+	case ok := <-req.reply:
+		c.Assert(ok, Equals, true)
+		checkDeltasEqual(c, req.changes, []params.Delta{{Entity: unit0Updated}})
+	default:
+		c.Fatalf("request was never replied to")
+	}
+}
+
+// TestWatchFilteredOptions exercises WatchOptions.filter directly,
+// checking that Kinds, IDGlob and Predicate combine with AND semantics
+// - matching requires every set field to match, not just one of them.
+func (*allWatcherSuite) TestWatchFilteredOptions(c *C) {
+	wordpress0 := &params.UnitInfo{Name: "wordpress/0", Service: "wordpress"}
+	mysql0 := &params.UnitInfo{Name: "mysql/0", Service: "mysql"}
+	machine0 := &params.MachineInfo{Id: "0"}
+
+	opts := WatchOptions{Kinds: []string{"unit"}}
+	filter := opts.filter()
+	c.Assert(filter.Match(wordpress0), Equals, true)
+	c.Assert(filter.Match(machine0), Equals, false)
+
+	opts = WatchOptions{Kinds: []string{"unit"}, IDGlob: "wordpress/*"}
+	filter = opts.filter()
+	c.Assert(filter.Match(wordpress0), Equals, true)
+	c.Assert(filter.Match(mysql0), Equals, false)
+
+	opts = WatchOptions{
+		Predicate: func(info params.EntityInfo) bool {
+			u, ok := info.(*params.UnitInfo)
+			return ok && u.Service == "mysql"
+		},
+	}
+	filter = opts.filter()
+	c.Assert(filter.Match(mysql0), Equals, true)
+	c.Assert(filter.Match(wordpress0), Equals, false)
+
+	// A zero-value WatchOptions matches everything, same as a
+	// StateWatcher with no filter set at all.
+	filter = WatchOptions{}.filter()
+	c.Assert(filter.Match(wordpress0), Equals, true)
+	c.Assert(filter.Match(machine0), Equals, true)
+}
+
 func (*allWatcherSuite) TestRespondMultiple(c *C) {
 	aw := newAllWatcher(newTestBacking(nil))
 	allInfoAdd(aw.all, &params.MachineInfo{Id: "0"})
@@ -599,6 +1247,35 @@ func (*allWatcherSuite) TestRespondMultiple(c *C) {
 	c.Assert(req1.changes, DeepEquals, deltas)
 }
 
+// TestRespondManyWatchersBoundedWorkers drives far more waiting
+// watchers than SetRespondWorkers allows to run at once through a
+// single respond call, checking that every one of them still gets
+// exactly the delta it's owed - respond's fan-out is bounded
+// concurrency, not a change in what each watcher is sent.
+func (*allWatcherSuite) TestRespondManyWatchersBoundedWorkers(c *C) {
+	aw := newAllWatcher(newTestBacking(nil))
+	aw.SetRespondWorkers(2)
+
+	const n = 20
+	watchers := make([]*StateWatcher, n)
+	reqs := make([]*allRequest, n)
+	for i := range watchers {
+		watchers[i] = &StateWatcher{all: aw}
+		reqs[i] = &allRequest{w: watchers[i], reply: make(chan bool, 1)}
+		aw.handle(reqs[i])
+	}
+
+	allInfoAdd(aw.all, &params.MachineInfo{Id: "0"})
+	aw.respond()
+
+	want := []params.Delta{{Revno: 1, Entity: &params.MachineInfo{Id: "0"}}}
+	for i, req := range reqs {
+		assertReplied(c, true, req)
+		c.Assert(req.changes, DeepEquals, want, Commentf("watcher %d", i))
+	}
+	assertWaitingRequests(c, aw, nil)
+}
+
 func (*allWatcherSuite) TestRunStop(c *C) {
 	aw := newAllWatcher(newTestBacking(nil))
 	go aw.run()
@@ -637,6 +1314,36 @@ func (*allWatcherSuite) TestRun(c *C) {
 	}, "")
 }
 
+// TestMemoryBackingRun is TestRun's counterpart for MemoryBacking,
+// checking that a StateWatcher driven by it sees the same add/update/
+// delete sequence a Mongo-backed one does.
+func (*allWatcherSuite) TestMemoryBackingRun(c *C) {
+	b := NewMemoryBacking([]params.EntityInfo{
+		&params.MachineInfo{Id: "0"},
+		&params.UnitInfo{Name: "wordpress/0"},
+		&params.ServiceInfo{Name: "wordpress"},
+	})
+	aw := newAllWatcher(b)
+	defer func() {
+		c.Check(aw.Stop(), IsNil)
+	}()
+	go aw.run()
+	w := &StateWatcher{all: aw}
+	checkNext(c, w, []params.Delta{
+		{Entity: &params.MachineInfo{Id: "0"}},
+		{Entity: &params.UnitInfo{Name: "wordpress/0"}},
+		{Entity: &params.ServiceInfo{Name: "wordpress"}},
+	}, "")
+	b.Update(&params.MachineInfo{Id: "0", InstanceId: "i-0"})
+	checkNext(c, w, []params.Delta{
+		{Entity: &params.MachineInfo{Id: "0", InstanceId: "i-0"}},
+	}, "")
+	b.Delete("machine", "0")
+	checkNext(c, w, []params.Delta{
+		{Removed: true, Entity: &params.MachineInfo{Id: "0"}},
+	}, "")
+}
+
 func (*allWatcherSuite) TestStateWatcherStop(c *C) {
 	aw := newAllWatcher(newTestBacking(nil))
 	defer func() {
@@ -672,6 +1379,59 @@ func (*allWatcherSuite) TestStateWatcherStopBecauseAllWatcherError(c *C) {
 	checkNext(c, w, nil, "some error")
 }
 
+// TestCursorResume stops a watcher mid-stream, mutates the backing -
+// updating one entity, removing another the watcher had already seen
+// (so it's purged from allInfo entirely before the resume, unlike a
+// watcher that's merely Stopped, which would have kept it pinned),
+// and adding a third - then resumes from the cursor and checks that
+// the prior deltas plus the resumed ones reconstruct the live state
+// exactly, agreeing with what a freshly connecting watcher sees for
+// every entity it's in a position to have an opinion about.
+func (*allWatcherSuite) TestCursorResume(c *C) {
+	b := newTestBacking([]params.EntityInfo{
+		&params.MachineInfo{Id: "0"},
+		&params.MachineInfo{Id: "1"},
+		&params.UnitInfo{Name: "wordpress/0"},
+	})
+	aw := newAllWatcher(b)
+	defer func() {
+		c.Check(aw.Stop(), IsNil)
+	}()
+	go aw.run()
+
+	w := &StateWatcher{all: aw}
+	initial, err := getNext(c, w, 1*time.Second)
+	c.Assert(err, IsNil)
+	wstate := make(watcherState)
+	wstate.update(initial)
+
+	cursor, err := w.Cursor()
+	c.Assert(err, IsNil)
+
+	b.updateEntity(&params.MachineInfo{Id: "0", InstanceId: "i-0"})
+	b.deleteEntity(testEntityId{"machine", "1"})
+	b.updateEntity(&params.UnitInfo{Name: "wordpress/1", Service: "wordpress"})
+
+	resumed, err := w.Resume(cursor)
+	c.Assert(err, IsNil)
+	resumedChanges, err := getNext(c, resumed, 1*time.Second)
+	c.Assert(err, IsNil)
+	checkDeltasEqual(c, resumedChanges, []params.Delta{
+		{Entity: &params.MachineInfo{Id: "0", InstanceId: "i-0"}},
+		{Removed: true, Entity: &params.MachineInfo{Id: "1"}},
+		{Entity: &params.UnitInfo{Name: "wordpress/1", Service: "wordpress"}},
+	})
+	wstate.update(resumedChanges)
+	wstate.check(c, aw.all)
+
+	fresh := &StateWatcher{all: aw}
+	freshChanges, err := getNext(c, fresh, 1*time.Second)
+	c.Assert(err, IsNil)
+	freshState := make(watcherState)
+	freshState.update(freshChanges)
+	freshState.check(c, aw.all)
+}
+
 type allWatcherStateSuite struct {
 	testing.LoggingSuite
 	testing.MgoSuite
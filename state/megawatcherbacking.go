@@ -0,0 +1,176 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"sync"
+
+	"labix.org/v2/mgo"
+
+	"launchpad.net/juju-core/state/api/params"
+	"launchpad.net/juju-core/state/watcher"
+)
+
+// memoryBackingId identifies an entity within a MemoryBacking: the
+// collection-like grouping plus whatever id is unique within it, the
+// same pairing allWatcherStateBacking derives from a Mongo collection
+// name and _id.
+type memoryBackingId struct {
+	kind string
+	id   interface{}
+}
+
+// memoryBackingEntry is what a MemoryBacking stores for a single
+// entity: its current state plus the modRevision it was last written
+// at, mirroring the (value, mod_revision) pair an etcd mvcc key
+// carries.
+type memoryBackingEntry struct {
+	info        params.EntityInfo
+	modRevision int64
+}
+
+// MemoryBacking is an allWatcherBacking that holds every entity in
+// memory rather than in Mongo, keyed and versioned the way an etcd
+// mvcc watcher would key and version them: every write - Update or
+// Delete - advances a single monotonic modRevision shared across the
+// whole backing, and Changed below tells a create, update or delete
+// apart from that same fetch-or-not-found shape
+// allWatcherStateBacking's own Mongo-backed Changed already uses,
+// rather than carrying isCreate/isDelete flags on the wire - watcher.Change,
+// defined outside this package, has no room for them, and every other
+// allWatcherBacking already gets by without them.
+//
+// A genuine etcd-backed implementation - one that actually dials a
+// cluster rather than only shaping its keys and revisions the way one
+// would - needs an etcd client library this tree doesn't vendor; that's
+// future work gated on adding that dependency. What MemoryBacking
+// delivers now is the other half of the request: a dependency-free
+// backing production code can hand to NewStateWatcher directly, not
+// just the test-only allWatcherTestBacking a *_test.go file can use.
+type MemoryBacking struct {
+	mu          sync.Mutex
+	entities    map[memoryBackingId]*memoryBackingEntry
+	modRevision int64
+	watchc      chan<- watcher.Change
+}
+
+// NewMemoryBacking returns a MemoryBacking seeded with initial, each
+// entry starting at modRevision 1.
+func NewMemoryBacking(initial []params.EntityInfo) *MemoryBacking {
+	b := &MemoryBacking{
+		entities: make(map[memoryBackingId]*memoryBackingEntry),
+	}
+	for _, info := range initial {
+		b.modRevision++
+		b.entities[memoryIdForInfo(info)] = &memoryBackingEntry{
+			info:        info,
+			modRevision: b.modRevision,
+		}
+	}
+	return b
+}
+
+// memoryIdForInfo returns the memoryBackingId info is stored and
+// watched under.
+func memoryIdForInfo(info params.EntityInfo) memoryBackingId {
+	return memoryBackingId{kind: info.EntityKind(), id: info.EntityId()}
+}
+
+// Update stores info, creating it if it's not already present,
+// advancing the backing's modRevision and notifying any watch
+// channel of the change.
+func (b *MemoryBacking) Update(info params.EntityInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := memoryIdForInfo(info)
+	b.modRevision++
+	b.entities[id] = &memoryBackingEntry{info: info, modRevision: b.modRevision}
+	b.notify(id)
+}
+
+// Delete removes the entity of the given kind and id, if present,
+// advancing the backing's modRevision and notifying any watch channel
+// of the change.
+func (b *MemoryBacking) Delete(kind string, id interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	memID := memoryBackingId{kind: kind, id: id}
+	if _, ok := b.entities[memID]; !ok {
+		return
+	}
+	delete(b.entities, memID)
+	b.modRevision++
+	b.notify(memID)
+}
+
+// notify sends a watcher.Change for id on b.watchc, if a watch is in
+// progress. b.mu must be held by the caller.
+func (b *MemoryBacking) notify(id memoryBackingId) {
+	if b.watchc == nil {
+		return
+	}
+	b.watchc <- watcher.Change{C: id.kind, Id: id.id, Revno: b.modRevision}
+}
+
+// watch implements allWatcherBacking.
+func (b *MemoryBacking) watch(c chan<- watcher.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watchc != nil {
+		panic("MemoryBacking can only watch once")
+	}
+	b.watchc = c
+}
+
+// unwatch implements allWatcherBacking.
+func (b *MemoryBacking) unwatch(c chan<- watcher.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c != b.watchc {
+		panic("unwatching wrong channel")
+	}
+	b.watchc = nil
+}
+
+// getAll implements allWatcherBacking.
+func (b *MemoryBacking) getAll(all *allInfo) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, entry := range b.entities {
+		all.update(id, entry.info)
+	}
+	return nil
+}
+
+// changed implements allWatcherBacking, telling a create or update
+// apart from a delete the same way allWatcherStateBacking's Mongo-backed
+// version does: by looking the entity back up and checking whether it's
+// still there, rather than via any flag on change itself.
+func (b *MemoryBacking) changed(all *allInfo, change watcher.Change) error {
+	id := memoryBackingId{kind: change.C, id: change.Id}
+	info, err := b.fetch(id)
+	if err == mgo.ErrNotFound {
+		all.update(id, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	all.update(id, info)
+	return nil
+}
+
+// fetch returns the current state of the entity named by id, or
+// mgo.ErrNotFound if it's been deleted, which is what changed (above)
+// checks for. allWatcherStateBacking's fetch reports the same case as
+// errEntityNotFound instead.
+func (b *MemoryBacking) fetch(id memoryBackingId) (params.EntityInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.entities[id]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return entry.info, nil
+}
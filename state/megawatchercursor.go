@@ -0,0 +1,202 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"container/heap"
+
+	"launchpad.net/juju-core/state/api/params"
+)
+
+// Cursor is an opaque token that lets a StateWatcher resume, via
+// Resume, from wherever it last left off rather than replaying the
+// entire world. It's returned by StateWatcher.Cursor.
+type Cursor struct {
+	// LatestRevno is the revno the StateWatcher had last been shown
+	// changes up to, when the cursor was taken.
+	LatestRevno int64
+
+	// Seen holds the creationRevno of every entity the StateWatcher
+	// held a reference to when the cursor was taken - live or
+	// removed-but-not-yet-acknowledged alike. A resumed StateWatcher
+	// consults it, against allInfo.tombstones, to learn about entities
+	// purged entirely while it was disconnected; it's a simple
+	// membership set rather than a true probabilistic bloom filter, so
+	// it has neither false positives nor false negatives.
+	Seen map[int64]bool
+
+	// token, while non-nil, holds this Cursor's place in
+	// allInfo.tokens, protecting the tombstones it might still need
+	// from pruning. It's cleared once the Cursor is given to Resume;
+	// a Cursor that's never resumed keeps its token outstanding
+	// forever, and with it every tombstone from its revno onward (see
+	// pruneTombstones).
+	token *activeToken
+}
+
+// activeToken is a single entry in allInfo.tokens, the min-heap of
+// outstanding Cursor revnos: one pushed per call to allWatcher.cursorFor,
+// removed again once the Cursor reaches
+// allWatcher.newStateWatcherFromCursor via Resume.
+type activeToken struct {
+	revno int64
+	index int
+}
+
+// tokenHeap implements container/heap.Interface over the revno of
+// every outstanding Cursor, so allInfo can cheaply ask for the oldest
+// one a pruneTombstones pass must not discard anything newer than.
+type tokenHeap []*activeToken
+
+func (h tokenHeap) Len() int { return len(h) }
+
+func (h tokenHeap) Less(i, j int) bool { return h[i].revno < h[j].revno }
+
+func (h tokenHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *tokenHeap) Push(x interface{}) {
+	t := x.(*activeToken)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *tokenHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// trackToken pushes revno onto a.tokens, returning the activeToken a
+// later call to untrackToken needs to remove it again.
+func (a *allInfo) trackToken(revno int64) *activeToken {
+	t := &activeToken{revno: revno}
+	heap.Push(&a.tokens, t)
+	return t
+}
+
+// untrackToken removes t from a.tokens, if it's still there. It's a
+// no-op given nil, so it's safe to call on a Cursor that was never
+// taken from a live StateWatcher.
+func (a *allInfo) untrackToken(t *activeToken) {
+	if t == nil || t.index < 0 {
+		return
+	}
+	heap.Remove(&a.tokens, t.index)
+}
+
+// Cursor detaches w from every entity it currently holds a reference
+// to - exactly as Stop would - and returns a token that Resume can
+// later use to pick up the stream again without requiring those
+// entities to stay pinned in allInfo for as long as w is disconnected.
+// Like Stop, w must not be used again afterwards.
+func (w *StateWatcher) Cursor() (Cursor, error) {
+	req := &allRequest{w: w, snapshot: make(chan Cursor, 1)}
+	select {
+	case w.all.request <- req:
+	case <-w.all.tomb.Dying():
+		return Cursor{}, w.stopError()
+	}
+	select {
+	case cur := <-req.snapshot:
+		return cur, nil
+	case <-w.all.tomb.Dying():
+		return Cursor{}, w.stopError()
+	}
+}
+
+// Resume returns a new StateWatcher continuing the stream cursor was
+// taken from: its first call to Next reports exactly what a
+// StateWatcher that had stayed connected throughout would have
+// reported on its first call after cursor was taken, including
+// Removed deltas for anything purged while disconnected. A filter or
+// delta format set on the watcher cursor was taken from isn't carried
+// over: the resumed StateWatcher is unfiltered and sends full deltas,
+// so the above holds for an unfiltered, FormatFull watcher. Only w.all is
+// used, so any StateWatcher sharing the same allWatcher as the one
+// cursor came from will do - including w itself, even though it was
+// detached by the call to Cursor that produced cursor.
+func (w *StateWatcher) Resume(cursor Cursor) (*StateWatcher, error) {
+	req := &allRequest{
+		attach:   &cursor,
+		attached: make(chan *StateWatcher, 1),
+	}
+	select {
+	case w.all.request <- req:
+	case <-w.all.tomb.Dying():
+		return nil, w.stopError()
+	}
+	select {
+	case resumed := <-req.attached:
+		return resumed, nil
+	case <-w.all.tomb.Dying():
+		return nil, w.stopError()
+	}
+}
+
+// cursorFor detaches w, as Stop would, returning a Cursor it can later
+// be Resumed from. It must only be called from the allWatcher's own
+// goroutine.
+func (aw *allWatcher) cursorFor(w *StateWatcher) Cursor {
+	for r := aw.waiting[w]; r != nil; r = r.next {
+		r.reply <- false
+	}
+	delete(aw.waiting, w)
+	aw.metrics().SetPendingRequests(w, 0)
+	seen := make(map[int64]bool)
+	aw.releaseKnownTo(w, func(entry *entityEntry) {
+		seen[entry.creationRevno] = true
+	})
+	w.stopped = true
+	aw.metrics().AddWatcherCount(-1)
+	return Cursor{
+		LatestRevno: w.revno,
+		Seen:        seen,
+		token:       aw.all.trackToken(w.revno),
+	}
+}
+
+// newStateWatcherFromCursor builds a StateWatcher resuming from
+// cursor, crediting it with a reference to every entity it would still
+// be holding one for had it never disconnected (see entityEntry.knownTo),
+// so allInfo.seen's bookkeeping stays consistent with a StateWatcher
+// that had stayed connected throughout. It must only be called from
+// the allWatcher's own goroutine.
+func (aw *allWatcher) newStateWatcherFromCursor(cursor Cursor) *StateWatcher {
+	aw.all.untrackToken(cursor.token)
+	w := &StateWatcher{
+		all:               aw,
+		revno:             cursor.LatestRevno,
+		pendingTombstones: cursor.Seen,
+	}
+	for _, elem := range aw.all.entities {
+		entry := elem.Value.(*entityEntry)
+		if entry.knownTo(cursor.LatestRevno) {
+			entry.refCount++
+		}
+	}
+	return w
+}
+
+// tombstoneDeltas returns a Removed delta for every tombstone whose
+// creationRevno is in seen, i.e. every entity a resuming StateWatcher
+// had been shown but that has since been purged entirely - and so
+// would otherwise look, from matchSince's point of view, exactly like
+// something it had never been told about in the first place.
+func (a *allInfo) tombstoneDeltas(seen map[int64]bool) []params.Delta {
+	var deltas []params.Delta
+	for _, t := range a.tombstones {
+		if seen[t.creationRevno] {
+			deltas = append(deltas, params.Delta{Removed: true, Entity: t.info})
+		}
+	}
+	return deltas
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"launchpad.net/juju-core/state/api/params"
+)
+
+// DeltaFormat selects how an allWatcher encodes the EntityInfo carried
+// by a params.Delta. StateWatcher.SetDeltaFormat picks the format a
+// particular watcher receives for its own future calls to Next.
+type DeltaFormat int
+
+const (
+	// FormatFull sends the complete EntityInfo on every change, as
+	// allWatcher has always done. It's the zero value, so existing
+	// watchers that never call SetDeltaFormat see no change in
+	// behaviour.
+	FormatFull DeltaFormat = iota
+
+	// FormatJSONPatch sends an RFC 6902 JSON Patch document - an
+	// ordered list of add/replace/remove operations, one per changed
+	// top-level field - describing how to turn the watcher's current
+	// local copy of the entity into its new state.
+	FormatJSONPatch
+
+	// FormatJSONMerge sends an RFC 7396 JSON Merge Patch document:
+	// unchanged fields are omitted, changed fields carry their new
+	// value, and removed fields are set to null.
+	FormatJSONMerge
+)
+
+// JSONPatchInfo carries a JSON Patch or JSON Merge Patch document
+// describing how an entity changed, rather than its full new state.
+// It satisfies params.EntityInfo by delegating EntityKind/EntityId to
+// the entity it patches, so routing code that only cares about kind
+// and id keeps working unmodified; code that wants to apply the patch
+// itself needs to type-assert for *JSONPatchInfo.
+type JSONPatchInfo struct {
+	kind string
+	id   interface{}
+
+	// Merge is true if Patch is an RFC 7396 JSON Merge Patch document
+	// rather than an RFC 6902 JSON Patch document.
+	Merge bool
+
+	// Patch holds the patch document itself.
+	Patch json.RawMessage
+}
+
+// EntityKind implements params.EntityInfo.
+func (p *JSONPatchInfo) EntityKind() string { return p.kind }
+
+// EntityId implements params.EntityInfo.
+func (p *JSONPatchInfo) EntityId() interface{} { return p.id }
+
+// jsonPatchOp is a single RFC 6902 JSON Patch operation.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// entryDelta builds the full-replacement params.Delta for entry. It's
+// used by allInfo.changesSince, which isn't tied to any particular
+// watcher and so has no per-watcher snapshot to diff a patch against.
+func (a *allInfo) entryDelta(id infoId, entry *entityEntry) params.Delta {
+	if entry.removed {
+		return params.Delta{Removed: true, Entity: entry.info}
+	}
+	return params.Delta{Entity: entry.info}
+}
+
+// entryDelta builds the params.Delta w should be sent for entry, in
+// w's own chosen delta format.
+func (w *StateWatcher) entryDelta(id infoId, entry *entityEntry) params.Delta {
+	return w.entryDeltaFormat(id, entry, w.format)
+}
+
+// entryDeltaFormat is entryDelta with the format passed in rather than
+// taken from w.format; entryDelta, passing w.format, is its only
+// caller.
+//
+// Diffing is against the last full state w itself was actually shown
+// for id - tracked in w.snapshots, and updated here on every call -
+// rather than against whatever allInfo last wrote for id, which may be
+// a state w was never shown at all if the entity changed more than
+// once between two of w's calls to Next. An id w has no snapshot for -
+// its first appearance, or the first time w has been asked to patch
+// against it - is always sent in full, and that full state becomes
+// the snapshot future patches diff against; any other failure to build
+// the patch falls back to a full send the same way, rather than drop
+// an update a client is relying on to stay in sync.
+func (w *StateWatcher) entryDeltaFormat(id infoId, entry *entityEntry, format DeltaFormat) params.Delta {
+	if entry.removed {
+		delete(w.snapshots, id)
+		return params.Delta{Removed: true, Entity: entry.info}
+	}
+	prev, ok := w.snapshots[id]
+	w.rememberSnapshot(id, entry.info)
+	if format == FormatFull || !ok {
+		return params.Delta{Entity: entry.info}
+	}
+	patch, err := newJSONPatchInfo(prev, entry.info, format)
+	if err != nil {
+		return params.Delta{Entity: entry.info}
+	}
+	return params.Delta{Entity: patch}
+}
+
+// rememberSnapshot records info as the last full state w has been
+// shown for id, so that a later patch-format delta for id has
+// something accurate of w's own to diff against.
+func (w *StateWatcher) rememberSnapshot(id infoId, info params.EntityInfo) {
+	if w.snapshots == nil {
+		w.snapshots = make(map[infoId]params.EntityInfo)
+	}
+	w.snapshots[id] = info
+}
+
+// newJSONPatchInfo builds a JSONPatchInfo describing how prev changed
+// into cur, in the given format.
+func newJSONPatchInfo(prev, cur params.EntityInfo, format DeltaFormat) (*JSONPatchInfo, error) {
+	prevFields, err := entityFields(prev)
+	if err != nil {
+		return nil, err
+	}
+	curFields, err := entityFields(cur)
+	if err != nil {
+		return nil, err
+	}
+	info := &JSONPatchInfo{kind: cur.EntityKind(), id: cur.EntityId()}
+	switch format {
+	case FormatJSONMerge:
+		doc, err := jsonMergePatch(prevFields, curFields)
+		if err != nil {
+			return nil, err
+		}
+		info.Merge = true
+		info.Patch = doc
+	default:
+		doc, err := jsonPatch(prevFields, curFields)
+		if err != nil {
+			return nil, err
+		}
+		info.Patch = doc
+	}
+	return info, nil
+}
+
+// entityFields marshals info to JSON and unpacks it one field deep, so
+// it can be diffed against another entity's fields without knowing its
+// concrete Go type.
+func entityFields(info params.EntityInfo) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// jsonPatch returns the RFC 6902 JSON Patch document that turns prev
+// into cur, as an ordered (by path, for determinism) list of
+// add/replace/remove operations covering every field that differs.
+func jsonPatch(prev, cur map[string]json.RawMessage) (json.RawMessage, error) {
+	var ops []jsonPatchOp
+	for field := range prev {
+		if _, ok := cur[field]; !ok {
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: "/" + field})
+		}
+	}
+	for field, value := range cur {
+		if old, ok := prev[field]; !ok {
+			ops = append(ops, jsonPatchOp{Op: "add", Path: "/" + field, Value: value})
+		} else if !bytes.Equal(old, value) {
+			ops = append(ops, jsonPatchOp{Op: "replace", Path: "/" + field, Value: value})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+	return json.Marshal(ops)
+}
+
+// jsonMergePatch returns the RFC 7396 JSON Merge Patch document that
+// turns prev into cur: changed and added fields carry their new
+// value, removed fields are set to null, and unchanged fields are
+// omitted entirely.
+func jsonMergePatch(prev, cur map[string]json.RawMessage) (json.RawMessage, error) {
+	merge := make(map[string]json.RawMessage, len(cur))
+	for field := range prev {
+		if _, ok := cur[field]; !ok {
+			merge[field] = json.RawMessage("null")
+		}
+	}
+	for field, value := range cur {
+		if old, ok := prev[field]; !ok || !bytes.Equal(old, value) {
+			merge[field] = value
+		}
+	}
+	return json.Marshal(merge)
+}
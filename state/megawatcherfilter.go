@@ -0,0 +1,251 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"launchpad.net/juju-core/state/api/params"
+)
+
+// EntityFilter decides whether a StateWatcher wants to see changes to
+// a given entity. A StateWatcher with no filter set (the default) sees
+// every entity; see StateWatcher.SetFilter.
+type EntityFilter interface {
+	Match(info params.EntityInfo) bool
+}
+
+// entityFilterFunc adapts a plain function to an EntityFilter.
+type entityFilterFunc func(info params.EntityInfo) bool
+
+func (f entityFilterFunc) Match(info params.EntityInfo) bool { return f(info) }
+
+// FilterByKind returns a filter matching every entity of the given
+// kind (params.EntityInfo.EntityKind(), e.g. "machine" or "service").
+func FilterByKind(kind string) EntityFilter {
+	return entityFilterFunc(func(info params.EntityInfo) bool {
+		return info.EntityKind() == kind
+	})
+}
+
+// FilterByService returns a filter matching the named service, and
+// any unit belonging to it.
+func FilterByService(name string) EntityFilter {
+	return entityFilterFunc(func(info params.EntityInfo) bool {
+		switch info := info.(type) {
+		case *params.ServiceInfo:
+			return info.Name == name
+		case *params.UnitInfo:
+			return info.Service == name
+		default:
+			return false
+		}
+	})
+}
+
+// FilterByMachineId returns a filter matching the named machine, and
+// any unit assigned to it.
+func FilterByMachineId(id string) EntityFilter {
+	return entityFilterFunc(func(info params.EntityInfo) bool {
+		switch info := info.(type) {
+		case *params.MachineInfo:
+			return info.Id == id
+		case *params.UnitInfo:
+			return info.MachineId == id
+		default:
+			return false
+		}
+	})
+}
+
+// FilterByTag returns a filter matching the entity with the given
+// juju tag (e.g. "machine-0", "unit-wordpress-0", "service-wordpress").
+func FilterByTag(tag string) EntityFilter {
+	return entityFilterFunc(func(info params.EntityInfo) bool {
+		return entityTag(info) == tag
+	})
+}
+
+// entityTag returns the conventional "kind-id" tag for info, or "" if
+// info is of a kind with no natural tag of its own (a relation, or an
+// annotation not attached to anything).
+func entityTag(info params.EntityInfo) string {
+	switch info := info.(type) {
+	case *params.MachineInfo:
+		return "machine-" + info.Id
+	case *params.UnitInfo:
+		return "unit-" + strings.Replace(info.Name, "/", "-", 1)
+	case *params.ServiceInfo:
+		return "service-" + info.Name
+	case *params.AnnotationInfo:
+		return info.Tag
+	default:
+		return ""
+	}
+}
+
+// AndFilter returns a filter matching an entity only if every one of
+// filters matches it.
+func AndFilter(filters ...EntityFilter) EntityFilter {
+	return entityFilterFunc(func(info params.EntityInfo) bool {
+		for _, f := range filters {
+			if !f.Match(info) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// OrFilter returns a filter matching an entity if any one of filters
+// matches it.
+func OrFilter(filters ...EntityFilter) EntityFilter {
+	return entityFilterFunc(func(info params.EntityInfo) bool {
+		for _, f := range filters {
+			if f.Match(info) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WatchOptions configures StateWatcher.WatchFiltered: see its doc
+// comment for how the fields combine.
+type WatchOptions struct {
+	// Kinds restricts matches to entities whose EntityKind() is one of
+	// these. An empty Kinds matches every kind.
+	Kinds []string
+
+	// IDGlob restricts matches to entities whose EntityId(), formatted
+	// with fmt.Sprint, matches this path.Match-style glob (e.g.
+	// "wordpress/*"). An empty IDGlob matches every id.
+	IDGlob string
+
+	// Predicate, if set, must also return true for a match. It runs
+	// last, after Kinds and IDGlob, so it only sees entities that
+	// already passed the cheaper checks.
+	Predicate func(info params.EntityInfo) bool
+}
+
+// filter builds the EntityFilter opts describes.
+func (opts WatchOptions) filter() EntityFilter {
+	var filters []EntityFilter
+	if len(opts.Kinds) > 0 {
+		kindFilters := make([]EntityFilter, len(opts.Kinds))
+		for i, kind := range opts.Kinds {
+			kindFilters[i] = FilterByKind(kind)
+		}
+		filters = append(filters, OrFilter(kindFilters...))
+	}
+	if opts.IDGlob != "" {
+		glob := opts.IDGlob
+		filters = append(filters, entityFilterFunc(func(info params.EntityInfo) bool {
+			matched, err := path.Match(glob, fmt.Sprint(info.EntityId()))
+			return err == nil && matched
+		}))
+	}
+	if opts.Predicate != nil {
+		filters = append(filters, entityFilterFunc(opts.Predicate))
+	}
+	return AndFilter(filters...)
+}
+
+// WatchFiltered is a convenience wrapper around SetFilter that builds
+// its EntityFilter from opts, mirroring the label/field selectors of a
+// Kubernetes watch, rather than requiring the caller to compose Kind,
+// glob and predicate matching by hand. It must be called before the
+// first call to Next, same as SetFilter.
+//
+// It narrows allInfo's retention cost along with what's sent over the
+// wire: refCount bookkeeping for a filtered watcher only credits it
+// for entities its filter actually matches (see filterDelta's
+// refAction), so an entity no other watcher cares about can be purged
+// the moment this one's filter stops matching it too, rather than
+// staying pinned until the watcher disconnects entirely.
+func (w *StateWatcher) WatchFiltered(opts WatchOptions) {
+	w.SetFilter(opts.filter())
+}
+
+// SetFilter restricts the entities future calls to Next report
+// changes for to those f matches; pass nil to go back to seeing every
+// entity, which is also the default. It must be called before the
+// first call to Next.
+//
+// An entity that stops matching f is delivered to this watcher as a
+// synthetic Removed delta, exactly as a real removal would be,
+// mirroring the semantics TestChangesSince already covers for real
+// removals: as far as this watcher can tell, the entity is gone.
+func (w *StateWatcher) SetFilter(f EntityFilter) {
+	w.filter = f
+	w.matched = make(map[infoId]bool)
+}
+
+// refAction tells applyResponse what a filterDelta call implies about
+// the reference w.filter holds on an entry's behalf: refTake when w
+// has just started depending on entry's current state and so must
+// eventually be told when it's gone, refRelease when w no longer does,
+// and refNone when nothing about w's reference to entry has changed.
+// It's only ever produced for a filtered watcher; an unfiltered one's
+// refCount bookkeeping is driven by allInfo.seen instead, exactly as
+// it always has been.
+type refAction int
+
+const (
+	refNone refAction = iota
+	refTake
+	refRelease
+)
+
+// filterDelta builds the delta, if any, that respond should send to w
+// for the change described by m, whether there's anything to send at
+// all, and what that implies for entry's refCount (see refAction).
+// w.matched tracks, for a filtered watcher only, which entities it
+// currently believes exist, so that a match-to-non-match transition
+// can be told apart from an entity it never saw in the first place;
+// it's also what makes refTake/refRelease correct, since a reference
+// is taken exactly when an id starts being tracked in w.matched and
+// released exactly when it stops.
+//
+// filterDelta only decides what ought to happen to entry's refCount;
+// it never mutates it, since that - like every other write to shared
+// allInfo state - is only safe on the allWatcher's own goroutine (see
+// buildResponse and applyResponse).
+func (w *StateWatcher) filterDelta(all *allInfo, m matchedChange) (params.Delta, bool, refAction) {
+	if w.filter == nil {
+		return w.entryDelta(m.id, m.entry), true, refNone
+	}
+	wasVisible := w.matched[m.id]
+	if m.entry.removed {
+		if !wasVisible {
+			return params.Delta{}, false, refNone
+		}
+		delete(w.matched, m.id)
+		return w.entryDelta(m.id, m.entry), true, refRelease
+	}
+	nowVisible := w.filter.Match(m.entry.info)
+	if nowVisible {
+		// Whether this is the first time w's filter has matched m.id or
+		// not, entryDelta already does the right thing: w.snapshots
+		// holds no entry for an id w has never matched before (the
+		// !nowVisible && wasVisible case below deletes it the moment w
+		// stops seeing an entity), so its first delta for a newly
+		// matched id is always sent in full, exactly as a genuinely new
+		// entity's would be.
+		ref := refNone
+		if !wasVisible {
+			ref = refTake
+		}
+		w.matched[m.id] = true
+		return w.entryDelta(m.id, m.entry), true, ref
+	}
+	if wasVisible {
+		delete(w.matched, m.id)
+		delete(w.snapshots, m.id)
+		return params.Delta{Removed: true, Entity: m.entry.info}, true, refRelease
+	}
+	return params.Delta{}, false, refNone
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"launchpad.net/juju-core/state/api/params"
+)
+
+// Collector receives counts and gauges describing the internal state
+// of the allWatcher machinery, so an operator can scrape a Juju state
+// server for it. Every method must be safe to call concurrently and
+// cheap, since allInfo and allWatcher call them on their hot paths.
+type Collector interface {
+	// AddWatcherCount reports that delta further StateWatchers are now
+	// live (delta may be negative, for one that's just stopped), so
+	// the gauge it drives tracks a running total across every live or
+	// resumed StateWatcher sharing an allWatcher, rather than each
+	// caller's own narrow view of going from 0 to 1 or back.
+	AddWatcherCount(delta int)
+
+	// SetPendingRequests reports the number of allRequests currently
+	// outstanding for a single StateWatcher.
+	SetPendingRequests(w *StateWatcher, n int)
+
+	// SetEntityCount reports the number of entries currently held by
+	// an allInfo, including those marked removed but retained because
+	// some watcher hasn't yet been shown their removal.
+	SetEntityCount(n int)
+
+	// SetRemovedEntityCount reports the number of entries currently
+	// marked removed but retained for that reason.
+	SetRemovedEntityCount(n int)
+
+	// AddRevnosIssued reports that n further revisions have been
+	// issued, i.e. that allInfo.latestRevno has advanced by n.
+	AddRevnosIssued(n int64)
+
+	// AddDeltaBytes reports that n further bytes of encoded
+	// params.Delta have been served to watchers.
+	AddDeltaBytes(n int)
+
+	// AddEntityChange reports a single add, update, remove or delete
+	// of an entity of the given kind (params.EntityInfo.EntityKind()).
+	// op is one of "add", "update", "remove" or "delete": "remove"
+	// marks an entity removed but still retained for some watcher;
+	// "delete" is its eventual purge, or an outright deletion that
+	// never needed to be retained.
+	AddEntityChange(kind, op string)
+}
+
+// nullCollector is a Collector that discards everything it's given.
+// It's the implicit collector for any allInfo or allWatcher that
+// hasn't had SetCollector called on it, so that metrics collection
+// stays entirely opt-in.
+type nullCollector struct{}
+
+func (nullCollector) AddWatcherCount(int)                   {}
+func (nullCollector) SetPendingRequests(*StateWatcher, int) {}
+func (nullCollector) SetEntityCount(int)                    {}
+func (nullCollector) SetRemovedEntityCount(int)             {}
+func (nullCollector) AddRevnosIssued(int64)                 {}
+func (nullCollector) AddDeltaBytes(int)                     {}
+func (nullCollector) AddEntityChange(string, string)        {}
+
+// entityChangeKey indexes PrometheusCollector.entityChanges by the
+// kind and op of an AddEntityChange call.
+type entityChangeKey struct {
+	kind string
+	op   string
+}
+
+// PrometheusCollector is a Collector that keeps the latest values in
+// memory and serves them as an http.Handler in the Prometheus text
+// exposition format, ready to be scraped.
+type PrometheusCollector struct {
+	mu sync.Mutex
+
+	watcherCount       int
+	pendingRequests    map[*StateWatcher]int
+	entityCount        int
+	removedEntityCount int
+	revnosIssued       int64
+	deltaBytes         int64
+	entityChanges      map[entityChangeKey]int64
+}
+
+// NewPrometheusCollector returns a Collector that also serves its
+// current values as an http.Handler.
+func NewPrometheusCollector() *PrometheusCollector {
+	return &PrometheusCollector{
+		pendingRequests: make(map[*StateWatcher]int),
+		entityChanges:   make(map[entityChangeKey]int64),
+	}
+}
+
+func (p *PrometheusCollector) AddWatcherCount(delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watcherCount += delta
+}
+
+func (p *PrometheusCollector) SetPendingRequests(w *StateWatcher, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n == 0 {
+		delete(p.pendingRequests, w)
+		return
+	}
+	p.pendingRequests[w] = n
+}
+
+func (p *PrometheusCollector) SetEntityCount(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entityCount = n
+}
+
+func (p *PrometheusCollector) SetRemovedEntityCount(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removedEntityCount = n
+}
+
+func (p *PrometheusCollector) AddRevnosIssued(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.revnosIssued += n
+}
+
+func (p *PrometheusCollector) AddDeltaBytes(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deltaBytes += int64(n)
+}
+
+func (p *PrometheusCollector) AddEntityChange(kind, op string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entityChanges[entityChangeKey{kind, op}]++
+}
+
+// pendingRequestTotal returns the sum of every watcher's pending
+// request count, for the aggregate gauge.
+func (p *PrometheusCollector) pendingRequestTotal() int {
+	total := 0
+	for _, n := range p.pendingRequests {
+		total += n
+	}
+	return total
+}
+
+// ServeHTTP implements http.Handler, writing the current values of
+// every metric in the Prometheus text exposition format.
+func (p *PrometheusCollector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE juju_state_watcher_count gauge\n")
+	fmt.Fprintf(w, "juju_state_watcher_count %d\n", p.watcherCount)
+	fmt.Fprintf(w, "# TYPE juju_state_watcher_pending_requests gauge\n")
+	fmt.Fprintf(w, "juju_state_watcher_pending_requests %d\n", p.pendingRequestTotal())
+	fmt.Fprintf(w, "# TYPE juju_state_allinfo_entities gauge\n")
+	fmt.Fprintf(w, "juju_state_allinfo_entities %d\n", p.entityCount)
+	fmt.Fprintf(w, "# TYPE juju_state_allinfo_removed_entities gauge\n")
+	fmt.Fprintf(w, "juju_state_allinfo_removed_entities %d\n", p.removedEntityCount)
+	fmt.Fprintf(w, "# TYPE juju_state_allinfo_revnos_issued_total counter\n")
+	fmt.Fprintf(w, "juju_state_allinfo_revnos_issued_total %d\n", p.revnosIssued)
+	fmt.Fprintf(w, "# TYPE juju_state_watcher_delta_bytes_total counter\n")
+	fmt.Fprintf(w, "juju_state_watcher_delta_bytes_total %d\n", p.deltaBytes)
+
+	fmt.Fprintf(w, "# TYPE juju_state_allinfo_entity_changes_total counter\n")
+	keys := make([]entityChangeKey, 0, len(p.entityChanges))
+	for k := range p.entityChanges {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].op < keys[j].op
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "juju_state_allinfo_entity_changes_total{kind=%q,op=%q} %d\n", k.kind, k.op, p.entityChanges[k])
+	}
+}
+
+// deltaSize returns the approximate number of bytes delta would take
+// on the wire, for AddDeltaBytes. A delta that can't be marshalled
+// (which shouldn't happen for any real params.Delta) contributes
+// nothing, rather than aborting the send it's only measuring.
+func deltaSize(delta params.Delta) int {
+	b, err := json.Marshal(delta)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
@@ -26,28 +26,43 @@ func NewCmdBlockHelper(api base.APICallCloser) CmdBlockHelper {
 	}
 }
 
-// on switches on desired block and
-// asserts that no errors were encountered.
-func (s *CmdBlockHelper) on(c *gc.C, blockType, msg string) {
-	c.Assert(s.blockClient.SwitchBlockOn(blockType, msg), gc.IsNil)
+// on switches on desired block, scoped to scope, and asserts that no
+// errors were encountered.
+func (s *CmdBlockHelper) on(c *gc.C, blockType, msg string, scope block.BlockScope) {
+	c.Assert(s.blockClient.SwitchBlockOn(blockType, msg, scope), gc.IsNil)
 }
 
 // BlockAllChanges switches changes block on.
 // This prevents all changes to juju environment.
 func (s *CmdBlockHelper) BlockAllChanges(c *gc.C, msg string) {
-	s.on(c, "BlockChange", msg)
+	s.on(c, "BlockChange", msg, block.MatchAllScope())
 }
 
 // BlockRemoveObject switches remove block on.
 // This prevents any object/entity removal on juju environment
 func (s *CmdBlockHelper) BlockRemoveObject(c *gc.C, msg string) {
-	s.on(c, "BlockRemove", msg)
+	s.on(c, "BlockRemove", msg, block.MatchAllScope())
 }
 
 // BlockDestroyModel switches destroy block on.
 // This prevents juju environment destruction.
 func (s *CmdBlockHelper) BlockDestroyModel(c *gc.C, msg string) {
-	s.on(c, "BlockDestroy", msg)
+	s.on(c, "BlockDestroy", msg, block.MatchAllScope())
+}
+
+// BlockFacadeMethods switches a changes block on, scoped to the given
+// "Facade.Method" glob patterns, e.g. []string{"Application.Destroy*"}.
+// Operations against any other facade method are left unaffected.
+func (s *CmdBlockHelper) BlockFacadeMethods(c *gc.C, patterns []string, msg string) {
+	s.on(c, "BlockChange", msg, block.FacadeMethodScope(patterns))
+}
+
+// BlockApplications switches a changes block on, scoped to the named
+// applications. Operations against any other application are left
+// unaffected - this is how a test (or an operator) freezes a single
+// production application while dev workloads keep working.
+func (s *CmdBlockHelper) BlockApplications(c *gc.C, apps []string, msg string) {
+	s.on(c, "BlockChange", msg, block.ApplicationScope(apps))
 }
 
 func (s *CmdBlockHelper) Close() {